@@ -0,0 +1,409 @@
+// Package client is a Go client for the MeterFlow API, with a typed method for each endpoint
+// and an http.RoundTripper waiting for a slot of a resource before each request.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rate limiting algorithms of a resource
+const (
+	AlgorithmSlidingWindow = "sliding_window"
+	AlgorithmTokenBucket   = "token_bucket"
+)
+
+// Priorities of the scheduled calls
+const (
+	PriorityHigh = "high"
+	PriorityLow  = "low"
+)
+
+// States of a job
+const (
+	JobScheduled = "scheduled" // Waiting for its slot
+	JobRunning   = "running"   // The request is being sent
+	JobCompleted = "completed" // The API answered, the result holds its response
+	JobFailed    = "failed"    // Every attempt failed, the result holds the last error or response
+	JobCancelled = "cancelled" // Cancelled before its request was sent
+)
+
+// Client calls the MeterFlow server at BaseURL
+type Client struct {
+	BaseURL    string       // For instance "http://localhost:8080"
+	Token      string       // Sent as a bearer token, for a MeterFlow server behind an authenticating proxy
+	HTTPClient *http.Client // Client used for the calls to MeterFlow, http.DefaultClient if nil
+}
+
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/")}
+}
+
+// Error is the answer of MeterFlow to a request it didn't fulfill
+type Error struct {
+	StatusCode int
+	Message    string
+	RetryAfter time.Duration // From the Retry-After header, 0 if missing
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("meterflow: %d %s", e.StatusCode, e.Message)
+}
+
+// Limit is a sliding window rule of a resource, stacked with its main limit
+type Limit struct {
+	RequestCount int `json:"request_count"`
+	TokenCount   int `json:"token_count,omitempty"`
+	TimeFrame    int `json:"time_frame,omitempty"`
+	TimeFrameMs  int `json:"time_frame_ms,omitempty"`
+}
+
+// Resource is a rate limited entity, see the resources endpoints for the meaning of each field
+type Resource struct {
+	Name           string  `json:"name"`
+	Algorithm      string  `json:"algorithm,omitempty"`
+	RequestCount   int     `json:"request_count,omitempty"`
+	TimeFrame      int     `json:"time_frame,omitempty"`
+	TimeFrameMs    int     `json:"time_frame_ms,omitempty"`
+	TokenCount     int     `json:"token_count,omitempty"`
+	Limits         []Limit `json:"limits,omitempty"`
+	Parent         string  `json:"parent,omitempty"`
+	Adaptive       bool    `json:"adaptive,omitempty"`
+	UpstreamURL    string  `json:"upstream_url,omitempty"`
+	BucketCapacity int     `json:"bucket_capacity,omitempty"`
+	RefillRate     float64 `json:"refill_rate,omitempty"`
+
+	HighPriorityShare float64            `json:"high_priority_share,omitempty"`
+	TenantCap         float64            `json:"tenant_cap,omitempty"`
+	TenantWeights     map[string]float64 `json:"tenant_weights,omitempty"`
+
+	EffectiveRequestCount int `json:"effective_request_count,omitempty"` // Only listed, for adaptive resources
+}
+
+// LimitStatus is the live usage of one limit of a resource
+type LimitStatus struct {
+	RequestCount    int   `json:"request_count"`
+	TokenCount      int   `json:"token_count,omitempty"`
+	TimeFrameMs     int64 `json:"time_frame_ms,omitempty"`
+	Used            int   `json:"used"`
+	Remaining       int   `json:"remaining"`
+	TokensUsed      int   `json:"tokens_used,omitempty"`
+	TokensRemaining int   `json:"tokens_remaining,omitempty"`
+	NextFreeAt      int64 `json:"next_free_at"`
+}
+
+// Status is the live usage of a resource, the timestamps are Unix milliseconds
+type Status struct {
+	Name        string        `json:"name"`
+	Algorithm   string        `json:"algorithm"`
+	Used        int           `json:"used"`
+	Remaining   int           `json:"remaining"`
+	NextFreeAt  int64         `json:"next_free_at"`
+	NextFreeMs  int64         `json:"next_free_ms"`
+	QueueEndAt  int64         `json:"queue_end_at"`
+	QueueMs     int64         `json:"queue_ms"`
+	PausedUntil int64         `json:"paused_until,omitempty"`
+	Limits      []LimitStatus `json:"limits"`
+}
+
+// Feedback is a response of the API, reported so that MeterFlow follows its actual limits
+type Feedback struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// FeedbackResult tells how MeterFlow changed the resource after a feedback
+type FeedbackResult struct {
+	PausedUntil           int64 `json:"paused_until,omitempty"`
+	ShiftedCalls          int   `json:"shifted_calls"`
+	ExternalCalls         int   `json:"external_calls"`
+	EffectiveRequestCount int   `json:"effective_request_count,omitempty"`
+}
+
+// ScheduleRequest asks for the delays of calls on a resource, see the schedule endpoint for the meaning of each field
+type ScheduleRequest struct {
+	ResourceName string `json:"resource_name"`
+	NumCalls     int    `json:"num_calls,omitempty"`
+	Weight       *int   `json:"weight,omitempty"` // nil for the default of 1 token, unlike a weight of 0
+	Weights      []int  `json:"weights,omitempty"`
+	DryRun       bool   `json:"dry_run,omitempty"`
+	MaxDelay     int    `json:"max_delay,omitempty"`
+	MaxDelayMs   int    `json:"max_delay_ms,omitempty"`
+	Deadline     int64  `json:"deadline,omitempty"`
+	Partial      bool   `json:"partial,omitempty"`
+	Priority     string `json:"priority,omitempty"`
+	Tenant       string `json:"tenant,omitempty"`
+}
+
+// Schedule is the delays of the scheduled calls, with their reservations unless it was a dry run
+type Schedule struct {
+	Delays       []int    `json:"delays"`    // Rounded up to whole seconds, approximate: waiting them can break the limit
+	DelaysMs     []int    `json:"delays_ms"` // Exact delays of the reserved slots
+	Reservations []string `json:"reservations,omitempty"`
+	Rejected     int      `json:"rejected,omitempty"`
+	DryRun       bool     `json:"dry_run,omitempty"`
+}
+
+// BatchItem is the calls to schedule on one resource of a batch
+type BatchItem struct {
+	ResourceName string `json:"resource_name"`
+	NumCalls     int    `json:"num_calls,omitempty"`
+	Weight       *int   `json:"weight,omitempty"` // 1 token if nil
+	Weights      []int  `json:"weights,omitempty"`
+	Priority     string `json:"priority,omitempty"`
+	Tenant       string `json:"tenant,omitempty"`
+}
+
+// BatchRequest asks for the delays of calls on several resources at once
+type BatchRequest struct {
+	Items   []BatchItem `json:"items"`
+	Aligned bool        `json:"aligned,omitempty"`
+	DryRun  bool        `json:"dry_run,omitempty"`
+}
+
+// BatchSchedule is the delays of the calls of each item of a batch, in the order of the request
+type BatchSchedule struct {
+	Items []struct {
+		ResourceName string   `json:"resource_name"`
+		Delays       []int    `json:"delays"`
+		DelaysMs     []int    `json:"delays_ms"`
+		Reservations []string `json:"reservations,omitempty"`
+	} `json:"items"`
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// AcquireRequest asks for a slot of a single call, see the acquire endpoint for the meaning of each field
+type AcquireRequest struct {
+	ResourceName string `json:"resource_name"`
+	Weight       *int   `json:"weight,omitempty"` // 1 token if nil
+	MaxWaitMs    int    `json:"max_wait_ms,omitempty"`
+	Priority     string `json:"priority,omitempty"`
+}
+
+// JobsRequest submits HTTP requests that MeterFlow sends itself, see the jobs endpoints for the meaning of each field
+type JobsRequest struct {
+	ResourceName string        `json:"resource_name"`
+	Requests     []HTTPRequest `json:"requests"`
+	Weight       *int          `json:"weight,omitempty"` // 1 token if nil
+	CallbackURL  string        `json:"callback_url,omitempty"`
+	MaxAttempts  int           `json:"max_attempts,omitempty"`
+	Priority     string        `json:"priority,omitempty"`
+	Tenant       string        `json:"tenant,omitempty"`
+}
+
+// HTTPRequest is a request MeterFlow sends to a rate limited API for a job
+type HTTPRequest struct {
+	Method  string            `json:"method,omitempty"` // GET if empty
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// JobResult is the outcome of the last attempt of a job
+type JobResult struct {
+	StatusCode int               `json:"status_code,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       string            `json:"body,omitempty"`
+	Error      string            `json:"error,omitempty"` // Set when no response was received
+}
+
+// Job is a request sent by MeterFlow on a slot of a resource, with its state
+type Job struct {
+	ID           string      `json:"id"`
+	ResourceName string      `json:"resource_name"`
+	Request      HTTPRequest `json:"request"`
+	Weight       int         `json:"weight,omitempty"`
+	Priority     string      `json:"priority,omitempty"`
+	Tenant       string      `json:"tenant,omitempty"`
+	CallbackURL  string      `json:"callback_url,omitempty"`
+	MaxAttempts  int         `json:"max_attempts"`
+
+	Status      string     `json:"status"` // One of the Job states
+	Attempts    int        `json:"attempts"`
+	ScheduledAt int64      `json:"scheduled_at"` // Unix timestamp (in milliseconds) of the next or last attempt
+	Reservation string     `json:"reservation,omitempty"`
+	Result      *JobResult `json:"result,omitempty"`
+}
+
+// SubmittedJob is a job accepted by MeterFlow, with the delay of its first attempt
+type SubmittedJob struct {
+	ID      string `json:"id"`
+	DelayMs int    `json:"delay_ms"`
+}
+
+// RegisterResource registers a new resource
+func (c *Client) RegisterResource(ctx context.Context, resource Resource) error {
+	return c.do(ctx, http.MethodPost, "/resources", resource, nil)
+}
+
+// ListResources returns every registered resource
+func (c *Client) ListResources(ctx context.Context) ([]Resource, error) {
+	var resources []Resource
+	err := c.do(ctx, http.MethodGet, "/resources", nil, &resources)
+	return resources, err
+}
+
+// UpdateResource replaces the settings of a resource, keeping its scheduled calls
+func (c *Client) UpdateResource(ctx context.Context, resource Resource) error {
+	return c.do(ctx, http.MethodPut, "/resources", resource, nil)
+}
+
+// DeleteResource deletes a resource
+func (c *Client) DeleteResource(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, "/resources", map[string]string{"name": name}, nil)
+}
+
+// ResourceStatus returns the live usage of a resource
+func (c *Client) ResourceStatus(ctx context.Context, name string) (*Status, error) {
+	var status Status
+	if err := c.do(ctx, http.MethodGet, "/resources/"+url.PathEscape(name)+"/status", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// ReportFeedback reports a response of the API of a resource
+func (c *Client) ReportFeedback(ctx context.Context, name string, feedback Feedback) (*FeedbackResult, error) {
+	var result FeedbackResult
+	if err := c.do(ctx, http.MethodPost, "/resources/"+url.PathEscape(name)+"/feedback", feedback, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Schedule returns the delays of calls on a resource, and reserves them unless it is a dry run
+func (c *Client) Schedule(ctx context.Context, request ScheduleRequest) (*Schedule, error) {
+	var schedule Schedule
+	if err := c.do(ctx, http.MethodPost, "/schedule", request, &schedule); err != nil {
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+// ScheduleBatch returns the delays of calls on several resources, and reserves them all or none
+func (c *Client) ScheduleBatch(ctx context.Context, request BatchRequest) (*BatchSchedule, error) {
+	var schedule BatchSchedule
+	if err := c.do(ctx, http.MethodPost, "/schedule/batch", request, &schedule); err != nil {
+		return nil, err
+	}
+	return &schedule, nil
+}
+
+// ReleaseReservation gives back the slot of a call that won't be made
+func (c *Client) ReleaseReservation(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/reservations/"+url.PathEscape(id), nil, nil)
+}
+
+// ReleaseReservations gives back the slots of several calls, and returns the number of reservations released
+func (c *Client) ReleaseReservations(ctx context.Context, ids []string) (int, error) {
+	var response struct {
+		Released int `json:"released"`
+	}
+	err := c.do(ctx, http.MethodDelete, "/reservations", map[string][]string{"ids": ids}, &response)
+	return response.Released, err
+}
+
+// Acquire waits until a single call can be made on a resource, and returns how long it waited.
+// If the context is done before, the slot is given back.
+func (c *Client) Acquire(ctx context.Context, request AcquireRequest) (time.Duration, error) {
+	var response struct {
+		WaitedMs int `json:"waited_ms"`
+	}
+	err := c.do(ctx, http.MethodPost, "/acquire", request, &response)
+	return time.Duration(response.WaitedMs) * time.Millisecond, err
+}
+
+// SubmitJobs submits HTTP requests that MeterFlow sends at the time of their slots
+func (c *Client) SubmitJobs(ctx context.Context, request JobsRequest) ([]SubmittedJob, error) {
+	var response struct {
+		Jobs []SubmittedJob `json:"jobs"`
+	}
+	err := c.do(ctx, http.MethodPost, "/jobs", request, &response)
+	return response.Jobs, err
+}
+
+// Job returns the state of a job, and the response of the API once it answered
+func (c *Client) Job(ctx context.Context, id string) (*Job, error) {
+	var job Job
+	if err := c.do(ctx, http.MethodGet, "/jobs/"+url.PathEscape(id), nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// CancelJob cancels a job waiting for its slot or its retry, and gives its slot back
+func (c *Client) CancelJob(ctx context.Context, id string) (*Job, error) {
+	var job Job
+	if err := c.do(ctx, http.MethodDelete, "/jobs/"+url.PathEscape(id), nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// do sends a request to MeterFlow with the JSON encoded body, if any, and decodes the JSON response into out, if any
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return responseError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// responseError returns the error answered by MeterFlow, from a plain text or a JSON body
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(resp.Body)
+	message := strings.TrimSpace(string(body))
+
+	var response struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &response) == nil && response.Error != "" {
+		message = response.Error
+	}
+
+	e := &Error{StatusCode: resp.StatusCode, Message: message}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return e
+}
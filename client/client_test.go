@@ -0,0 +1,331 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"meter_flow/dispatch"
+	"meter_flow/handlers"
+	"meter_flow/server"
+	"meter_flow/storage"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client of a MeterFlow server serving the endpoints of main.go
+func newTestClient(t *testing.T) *Client {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+	dispatcher := dispatch.NewDispatcher(http.DefaultClient, handlers.JobSlots(server))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /resources", handlers.RegisterResource(server))
+	mux.HandleFunc("GET /resources", handlers.ListResources(server))
+	mux.HandleFunc("PUT /resources", handlers.UpdateResource(server))
+	mux.HandleFunc("DELETE /resources", handlers.DeleteResource(server))
+	mux.HandleFunc("GET /resources/{name}/status", handlers.ResourceStatus(server))
+	mux.HandleFunc("POST /resources/{name}/feedback", handlers.ResourceFeedback(server))
+	mux.HandleFunc("POST /schedule", handlers.ScheduleCalls(server))
+	mux.HandleFunc("POST /schedule/batch", handlers.ScheduleBatch(server))
+	mux.HandleFunc("DELETE /reservations/{id}", handlers.ReleaseReservation(server))
+	mux.HandleFunc("DELETE /reservations", handlers.ReleaseReservations(server))
+	mux.HandleFunc("POST /acquire", handlers.AcquireSlot(server))
+	mux.HandleFunc("POST /jobs", handlers.SubmitJobs(server, dispatcher))
+	mux.HandleFunc("GET /jobs/{id}", handlers.JobStatus(dispatcher))
+	mux.HandleFunc("DELETE /jobs/{id}", handlers.CancelJob(dispatcher))
+
+	meterFlow := httptest.NewServer(mux)
+	t.Cleanup(meterFlow.Close)
+	return New(meterFlow.URL + "/")
+}
+
+func TestClient(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	if err := c.RegisterResource(ctx, Resource{Name: "test_resource", RequestCount: 2, TimeFrame: 60}); err != nil {
+		t.Fatalf("failed to register resource: %v", err)
+	}
+
+	// Test cases, run in order on the same resource
+	testCases := []struct {
+		name           string
+		call           func() error
+		expectedStatus int // Status of the error answered by MeterFlow, 0 for no error
+	}{
+		{
+			name: "Duplicate resource",
+			call: func() error {
+				return c.RegisterResource(ctx, Resource{Name: "test_resource", RequestCount: 2, TimeFrame: 60})
+			},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name: "List resources",
+			call: func() error {
+				resources, err := c.ListResources(ctx)
+				if err == nil && (len(resources) != 1 || resources[0].RequestCount != 2) {
+					t.Errorf("expected the registered resource, got %+v", resources)
+				}
+				return err
+			},
+		},
+		{
+			name: "Schedule calls",
+			call: func() error {
+				schedule, err := c.Schedule(ctx, ScheduleRequest{ResourceName: "test_resource", NumCalls: 1})
+				if err == nil && (len(schedule.DelaysMs) != 1 || len(schedule.Reservations) != 1) {
+					t.Errorf("expected 1 reserved call, got %+v", schedule)
+				}
+				if err == nil {
+					err = c.ReleaseReservation(ctx, schedule.Reservations[0])
+				}
+				return err
+			},
+		},
+		{
+			name: "Schedule a batch",
+			call: func() error {
+				schedule, err := c.ScheduleBatch(ctx, BatchRequest{Items: []BatchItem{{ResourceName: "test_resource", NumCalls: 2}}})
+				if err == nil && (len(schedule.Items) != 1 || len(schedule.Items[0].Reservations) != 2) {
+					t.Errorf("expected 2 reserved calls, got %+v", schedule)
+				}
+				if err == nil {
+					var released int
+					released, err = c.ReleaseReservations(ctx, schedule.Items[0].Reservations)
+					if released != 2 {
+						t.Errorf("expected 2 released reservations, got %d", released)
+					}
+				}
+				return err
+			},
+		},
+		{
+			name: "Acquire a slot",
+			call: func() error {
+				waited, err := c.Acquire(ctx, AcquireRequest{ResourceName: "test_resource"})
+				if waited != 0 {
+					t.Errorf("expected no wait, got %v", waited)
+				}
+				return err
+			},
+		},
+		{
+			name: "Slot beyond the maximum wait",
+			call: func() error {
+				c.Acquire(ctx, AcquireRequest{ResourceName: "test_resource"})
+				_, err := c.Acquire(ctx, AcquireRequest{ResourceName: "test_resource", MaxWaitMs: 100})
+				var e *Error
+				if errors.As(err, &e) && e.RetryAfter == 0 {
+					t.Errorf("expected a Retry-After, got %+v", e)
+				}
+				return err
+			},
+			expectedStatus: http.StatusTooManyRequests,
+		},
+		{
+			name: "Rejected calls",
+			call: func() error {
+				_, err := c.Schedule(ctx, ScheduleRequest{ResourceName: "test_resource", NumCalls: 1, MaxDelay: 1})
+				var e *Error
+				if errors.As(err, &e) && e.Message != "Calls exceed the maximum delay" {
+					t.Errorf("expected the error of the JSON body, got %q", e.Message)
+				}
+				return err
+			},
+			expectedStatus: http.StatusTooManyRequests,
+		},
+		{
+			name: "Resource status",
+			call: func() error {
+				status, err := c.ResourceStatus(ctx, "test_resource")
+				if err == nil && (status.Used != 2 || status.Remaining != 0) {
+					t.Errorf("expected 2 used calls, got %+v", status)
+				}
+				return err
+			},
+		},
+		{
+			name: "Report a throttled call",
+			call: func() error {
+				result, err := c.ReportFeedback(ctx, "test_resource", Feedback{Status: http.StatusTooManyRequests, Headers: map[string]string{"Retry-After": "1"}})
+				if err == nil && result.PausedUntil == 0 {
+					t.Errorf("expected the resource to be paused, got %+v", result)
+				}
+				return err
+			},
+		},
+		{
+			name: "Update the resource",
+			call: func() error {
+				return c.UpdateResource(ctx, Resource{Name: "test_resource", RequestCount: 5, TimeFrame: 60})
+			},
+		},
+		{
+			name: "Resource not found",
+			call: func() error {
+				_, err := c.ResourceStatus(ctx, "non_existent_resource")
+				return err
+			},
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name: "Delete the resource",
+			call: func() error {
+				return c.DeleteResource(ctx, "test_resource")
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.call()
+
+			// Check the error answered by MeterFlow
+			status := 0
+			var e *Error
+			if errors.As(err, &e) {
+				status = e.StatusCode
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if status != tc.expectedStatus {
+				t.Errorf("expected status code %d, got %d (%v)", tc.expectedStatus, status, err)
+			}
+		})
+	}
+}
+
+func TestClientWeights(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	// An API limited to 10 requests and 1 token per minute
+	if err := c.RegisterResource(ctx, Resource{Name: "test_resource", RequestCount: 10, TokenCount: 1, TimeFrame: 60}); err != nil {
+		t.Fatalf("failed to register resource: %v", err)
+	}
+
+	// A weight of 0 is sent as is, the calls use no token
+	schedule, err := c.Schedule(ctx, ScheduleRequest{ResourceName: "test_resource", NumCalls: 3, Weight: new(int)})
+	if err != nil || !reflect.DeepEqual(schedule.DelaysMs, []int{0, 0, 0}) {
+		t.Errorf("expected the calls without tokens to be made right away, got %+v (%v)", schedule, err)
+	}
+
+	// Without a weight each call counts as 1 token
+	schedule, err = c.Schedule(ctx, ScheduleRequest{ResourceName: "test_resource", NumCalls: 2})
+	if err != nil || len(schedule.DelaysMs) != 2 || schedule.DelaysMs[0] != 0 || schedule.DelaysMs[1] < 59000 {
+		t.Errorf("expected the second call a minute later, got %+v (%v)", schedule, err)
+	}
+}
+func TestClientJobs(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pong"))
+	}))
+	defer api.Close()
+
+	if err := c.RegisterResource(ctx, Resource{Name: "test_resource", RequestCount: 10, TimeFrame: 60}); err != nil {
+		t.Fatalf("failed to register resource: %v", err)
+	}
+	jobs, err := c.SubmitJobs(ctx, JobsRequest{ResourceName: "test_resource", Requests: []HTTPRequest{{URL: api.URL}}})
+	if err != nil || len(jobs) != 1 {
+		t.Fatalf("expected 1 submitted job, got %+v (%v)", jobs, err)
+	}
+
+	// Poll the job until it is finished
+	var job *Job
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if job, err = c.Job(ctx, jobs[0].ID); err != nil {
+			t.Fatalf("failed to get job: %v", err)
+		}
+		if job.Status == JobCompleted || job.Status == JobFailed {
+			break
+		}
+	}
+	if job.Status != JobCompleted || job.Result.Body != "pong" {
+		t.Errorf("expected the job to be completed, got %+v", job)
+	}
+
+	// A finished job can't be cancelled
+	if _, err := c.CancelJob(ctx, jobs[0].ID); err == nil {
+		t.Errorf("expected an error cancelling a finished job")
+	}
+}
+
+func TestTransport(t *testing.T) {
+	c := newTestClient(t)
+	if err := c.RegisterResource(context.Background(), Resource{Name: "test_api", RequestCount: 1, TimeFrameMs: 300}); err != nil {
+		t.Fatalf("failed to register resource: %v", err)
+	}
+
+	var received atomic.Int32
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+	}))
+	defer api.Close()
+	httpClient := &http.Client{Transport: NewTransport(c, "test_api", nil)}
+
+	// Test cases, run in order on the same resource
+	testCases := []struct {
+		name             string
+		timeout          time.Duration // Timeout of the request, 0 for none
+		expectedError    bool
+		expectedWait     time.Duration
+		expectedReceived int32
+	}{
+		{
+			name:             "Request sent right away",
+			expectedReceived: 1,
+		},
+		{
+			name:             "Request held until the next slot",
+			expectedWait:     250 * time.Millisecond,
+			expectedReceived: 2,
+		},
+		{
+			name:             "Request cancelled while waiting",
+			timeout:          50 * time.Millisecond,
+			expectedError:    true,
+			expectedReceived: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tc.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+			req, err := http.NewRequestWithContext(ctx, "GET", api.URL, nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+
+			start := time.Now()
+			resp, err := httpClient.Do(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tc.expectedError {
+				t.Errorf("expected error %v, got %v", tc.expectedError, err)
+			}
+
+			// Check the request waited for its slot
+			if elapsed := time.Since(start); elapsed < tc.expectedWait {
+				t.Errorf("expected the request to wait at least %v, got %v", tc.expectedWait, elapsed)
+			}
+
+			// Check the API only received the requests whose slot came
+			if count := received.Load(); count != tc.expectedReceived {
+				t.Errorf("expected the API to receive %d requests, got %d", tc.expectedReceived, count)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package client
+
+import "net/http"
+
+// Transport is an http.RoundTripper waiting for a slot of a resource before sending each request.
+// If the context of the request is done while waiting, the slot is given back and the request isn't sent.
+//
+//	httpClient := &http.Client{Transport: client.NewTransport(client.New("http://localhost:8080"), "openai_api", nil)}
+type Transport struct {
+	Client   *Client
+	Resource string            // Name of the resource limiting the requests
+	Priority string            // Priority of the requests, high if empty
+	Base     http.RoundTripper // Transport sending the requests once their slot has come, http.DefaultTransport if nil
+}
+
+func NewTransport(client *Client, resource string, base http.RoundTripper) *Transport {
+	return &Transport{
+		Client:   client,
+		Resource: resource,
+		Base:     base,
+	}
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	_, err := t.Client.Acquire(req.Context(), AcquireRequest{ResourceName: t.Resource, Priority: t.Priority})
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
@@ -0,0 +1,124 @@
+// Command meterflowctl manages the resources of a MeterFlow server.
+//
+//	meterflowctl [-url URL] [-o table|json] COMMAND [ARGS]
+//
+// The server URL and token are read from the -url flag, the METERFLOW_URL and METERFLOW_TOKEN environment variables,
+// or the config file ($METERFLOW_CONFIG, by default meterflowctl/config.json in the user config directory), in that
+// order of precedence.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"meter_flow/client"
+	"os"
+	"path/filepath"
+)
+
+const usage = `Usage: meterflowctl [-url URL] [-o table|json] COMMAND [ARGS]
+
+Commands:
+  resources list                       List the registered resources
+  resources get NAME                   Show a resource
+  resources create [FLAGS]             Register a resource, from flags or a JSON file (-f)
+  resources update [FLAGS]             Replace the settings of a resource, keeping its scheduled calls
+  resources delete NAME                Delete a resource
+  schedule -resource NAME -calls N     Schedule calls and print their delays
+  status [NAME]                        Show the live usage of a resource, or of every resource
+  export [-f FILE]                     Write every resource as JSON, to stdout by default
+  import -f FILE                       Create or update the resources of an exported file
+`
+
+// config is the connection to the MeterFlow server
+type config struct {
+	URL   string `json:"url"`
+	Token string `json:"token"`
+}
+
+// loadConfig reads the config file, then the environment variables overriding it
+func loadConfig() (config, error) {
+	cfg := config{URL: "http://localhost:8080"}
+
+	path := os.Getenv("METERFLOW_CONFIG")
+	if path == "" {
+		if dir, err := os.UserConfigDir(); err == nil {
+			path = filepath.Join(dir, "meterflowctl", "config.json")
+		}
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			if err := json.Unmarshal(data, &cfg); err != nil {
+				return cfg, fmt.Errorf("invalid config file %s: %w", path, err)
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return cfg, err
+		}
+	}
+
+	if url := os.Getenv("METERFLOW_URL"); url != "" {
+		cfg.URL = url
+	}
+	if token := os.Getenv("METERFLOW_TOKEN"); token != "" {
+		cfg.Token = token
+	}
+	return cfg, nil
+}
+
+func main() {
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := run(context.Background(), cfg, os.Args[1:], os.Stdout); errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// run runs the command given by the arguments, writing its output to out
+func run(ctx context.Context, cfg config, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("meterflowctl", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(flags.Output(), usage) }
+	url := flags.String("url", cfg.URL, "URL of the MeterFlow server")
+	format := flags.String("o", "table", "Output format, table or json")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *format != "table" && *format != "json" {
+		return fmt.Errorf("unknown output format %q", *format)
+	}
+
+	c := client.New(*url)
+	c.Token = cfg.Token
+	p := printer{out: out, json: *format == "json"}
+
+	args = flags.Args()
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	switch args[0] {
+	case "resources":
+		if len(args) < 2 {
+			return errors.New(usage)
+		}
+		return runResources(ctx, c, p, args[1], args[2:])
+	case "schedule":
+		return runSchedule(ctx, c, p, args[1:])
+	case "status":
+		return runStatus(ctx, c, p, args[1:])
+	case "export":
+		return runExport(ctx, c, out, args[1:])
+	case "import":
+		return runImport(ctx, c, out, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q\n\n%s", args[0], usage)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"meter_flow/handlers"
+	"meter_flow/server"
+	"meter_flow/storage"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestConfig returns the config of a MeterFlow server serving the resources and schedule endpoints
+func newTestConfig(t *testing.T) config {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /resources", handlers.RegisterResource(server))
+	mux.HandleFunc("GET /resources", handlers.ListResources(server))
+	mux.HandleFunc("PUT /resources", handlers.UpdateResource(server))
+	mux.HandleFunc("DELETE /resources", handlers.DeleteResource(server))
+	mux.HandleFunc("GET /resources/{name}/status", handlers.ResourceStatus(server))
+	mux.HandleFunc("POST /schedule", handlers.ScheduleCalls(server))
+
+	meterFlow := httptest.NewServer(mux)
+	t.Cleanup(meterFlow.Close)
+	return config{URL: meterFlow.URL}
+}
+
+func TestRun(t *testing.T) {
+	cfg := newTestConfig(t)
+	exported := filepath.Join(t.TempDir(), "resources.json")
+
+	// Test cases, run in order on the same server
+	testCases := []struct {
+		name           string
+		args           string
+		expectedError  bool
+		expectedOutput []string // Substrings of the output
+	}{
+		{
+			name:           "Create a resource",
+			args:           "resources create -name test_api -requests 2 -time-frame 60",
+			expectedOutput: []string{"Resource test_api created"},
+		},
+		{
+			name:           "Create a child resource",
+			args:           "resources create -name test_key -requests 1 -time-frame-ms 500 -parent test_api",
+			expectedOutput: []string{"Resource test_key created"},
+		},
+		{
+			name:          "Duplicate resource",
+			args:          "resources create -name test_api -requests 2 -time-frame 60",
+			expectedError: true,
+		},
+		{
+			name:           "List resources",
+			args:           "resources list",
+			expectedOutput: []string{"NAME", "test_api  sliding_window  2/1m0s", "test_key  sliding_window  1/500ms  test_api"},
+		},
+		{
+			name:           "Get a resource as JSON",
+			args:           "-o json resources get test_key",
+			expectedOutput: []string{`"name": "test_key"`, `"parent": "test_api"`},
+		},
+		{
+			name:           "Schedule calls",
+			args:           "schedule -resource test_api -calls 3 -dry-run",
+			expectedOutput: []string{"CALL", "1     0s", "3     1m0s"},
+		},
+		{
+			name:           "Status",
+			args:           "status test_api",
+			expectedOutput: []string{"USED", "test_api  sliding_window  0     2"},
+		},
+		{
+			name: "Export",
+			args: "export -f " + exported,
+		},
+		{
+			name:           "Update a resource",
+			args:           "resources update -name test_api -requests 5 -time-frame 60",
+			expectedOutput: []string{"Resource test_api updated"},
+		},
+		{
+			name:           "Delete the child resource",
+			args:           "resources delete test_key",
+			expectedOutput: []string{"Resource test_key deleted"},
+		},
+		{
+			name:           "Import",
+			args:           "import -f " + exported,
+			expectedOutput: []string{"1 resources created, 1 updated"},
+		},
+		{
+			name:           "Imported settings",
+			args:           "-o json resources get test_api",
+			expectedOutput: []string{`"request_count": 2`},
+		},
+		{
+			name:          "Resource not found",
+			args:          "resources get non_existent_resource",
+			expectedError: true,
+		},
+		{
+			name:          "Unknown command",
+			args:          "reboot",
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := run(context.Background(), cfg, strings.Fields(tc.args), &out)
+
+			// Check the error
+			if (err != nil) != tc.expectedError {
+				t.Fatalf("expected error %v, got %v", tc.expectedError, err)
+			}
+
+			// Check the output
+			for _, expected := range tc.expectedOutput {
+				if !strings.Contains(out.String(), expected) {
+					t.Errorf("expected output to contain %q, got:\n%s", expected, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data, _ := json.Marshal(config{URL: "http://meterflow.internal:8080", Token: "file_token"})
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	t.Setenv("METERFLOW_CONFIG", path)
+
+	// The config file is read
+	t.Setenv("METERFLOW_URL", "")
+	t.Setenv("METERFLOW_TOKEN", "")
+	cfg, err := loadConfig()
+	if err != nil || cfg.URL != "http://meterflow.internal:8080" || cfg.Token != "file_token" {
+		t.Errorf("expected the config of the file, got %+v (%v)", cfg, err)
+	}
+
+	// The environment variables override it
+	t.Setenv("METERFLOW_TOKEN", "env_token")
+	cfg, err = loadConfig()
+	if err != nil || cfg.URL != "http://meterflow.internal:8080" || cfg.Token != "env_token" {
+		t.Errorf("expected the token of the environment, got %+v (%v)", cfg, err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"meter_flow/client"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// printer writes the results of the commands as tables or JSON
+type printer struct {
+	out  io.Writer
+	json bool
+}
+
+// print writes the value as indented JSON, or as a table with one row per line of rows
+func (p printer) print(value interface{}, header []string, rows [][]string) error {
+	if p.json {
+		encoder := json.NewEncoder(p.out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	}
+
+	w := tabwriter.NewWriter(p.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+func (p printer) resources(resources []client.Resource) error {
+	rows := make([][]string, 0, len(resources))
+	for _, resource := range resources {
+		rows = append(rows, []string{resource.Name, algorithm(resource.Algorithm), limitSummary(resource), orDash(resource.Parent), orDash(resource.UpstreamURL)})
+	}
+	return p.print(resources, []string{"NAME", "ALGORITHM", "LIMIT", "PARENT", "UPSTREAM"}, rows)
+}
+
+func (p printer) statuses(statuses []*client.Status) error {
+	now := time.Now().UnixMilli()
+	rows := make([][]string, 0, len(statuses))
+	for _, status := range statuses {
+		paused := "-"
+		if status.PausedUntil > now {
+			paused = millis(status.PausedUntil - now)
+		}
+		rows = append(rows, []string{status.Name, algorithm(status.Algorithm), fmt.Sprint(status.Used), fmt.Sprint(status.Remaining), millis(status.NextFreeMs), millis(status.QueueMs), paused})
+	}
+	var value interface{} = statuses
+	if len(statuses) == 1 {
+		value = statuses[0]
+	}
+	return p.print(value, []string{"NAME", "ALGORITHM", "USED", "REMAINING", "NEXT FREE", "QUEUE", "PAUSED"}, rows)
+}
+
+func (p printer) schedule(schedule *client.Schedule) error {
+	rows := make([][]string, 0, len(schedule.DelaysMs))
+	for i, delay := range schedule.DelaysMs {
+		reservation := "-"
+		if i < len(schedule.Reservations) {
+			reservation = schedule.Reservations[i]
+		}
+		rows = append(rows, []string{fmt.Sprint(i + 1), millis(int64(delay)), reservation})
+	}
+	return p.print(schedule, []string{"CALL", "DELAY", "RESERVATION"}, rows)
+}
+
+// limitSummary describes the main limit of a resource, like "100/1m0s" or "10+2/s" for a token bucket
+func limitSummary(resource client.Resource) string {
+	if resource.Algorithm == client.AlgorithmTokenBucket {
+		return fmt.Sprintf("%d+%g/s", resource.BucketCapacity, resource.RefillRate)
+	}
+	timeFrame := time.Duration(resource.TimeFrame) * time.Second
+	if resource.TimeFrameMs > 0 {
+		timeFrame = time.Duration(resource.TimeFrameMs) * time.Millisecond
+	}
+	summary := fmt.Sprintf("%d/%v", resource.RequestCount, timeFrame)
+	if resource.Adaptive {
+		summary = fmt.Sprintf("%d of %s", resource.EffectiveRequestCount, summary)
+	}
+	if resource.TokenCount > 0 {
+		summary += fmt.Sprintf(", %d tokens", resource.TokenCount)
+	}
+	if len(resource.Limits) > 0 {
+		summary += fmt.Sprintf(" (+%d limits)", len(resource.Limits))
+	}
+	return summary
+}
+
+// algorithm returns the algorithm of a resource, the sliding window if empty
+func algorithm(name string) string {
+	if name == "" {
+		return client.AlgorithmSlidingWindow
+	}
+	return name
+}
+
+func millis(ms int64) string {
+	return (time.Duration(ms) * time.Millisecond).String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"meter_flow/client"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+func runResources(ctx context.Context, c *client.Client, p printer, command string, args []string) error {
+	switch command {
+	case "list":
+		resources, err := c.ListResources(ctx)
+		if err != nil {
+			return err
+		}
+		slices.SortFunc(resources, func(a, b client.Resource) int { return strings.Compare(a.Name, b.Name) })
+		return p.resources(resources)
+	case "get":
+		if len(args) != 1 {
+			return errors.New("usage: meterflowctl resources get NAME")
+		}
+		resource, err := findResource(ctx, c, args[0])
+		if err != nil {
+			return err
+		}
+		if p.json {
+			return p.print(resource, nil, nil)
+		}
+		return p.resources([]client.Resource{resource})
+	case "create", "update":
+		resource, err := parseResource(command, args)
+		if err != nil {
+			return err
+		}
+		if command == "create" {
+			err = c.RegisterResource(ctx, resource)
+		} else {
+			err = c.UpdateResource(ctx, resource)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(p.out, "Resource %s %sd\n", resource.Name, command)
+		return nil
+	case "delete":
+		if len(args) != 1 {
+			return errors.New("usage: meterflowctl resources delete NAME")
+		}
+		if err := c.DeleteResource(ctx, args[0]); err != nil {
+			return err
+		}
+		fmt.Fprintf(p.out, "Resource %s deleted\n", args[0])
+		return nil
+	default:
+		return fmt.Errorf("unknown resources command %q", command)
+	}
+}
+
+// findResource returns the registered resource with the given name
+func findResource(ctx context.Context, c *client.Client, name string) (client.Resource, error) {
+	resources, err := c.ListResources(ctx)
+	if err != nil {
+		return client.Resource{}, err
+	}
+	i := slices.IndexFunc(resources, func(resource client.Resource) bool { return resource.Name == name })
+	if i < 0 {
+		return client.Resource{}, fmt.Errorf("resource %s not found", name)
+	}
+	return resources[i], nil
+}
+
+// parseResource returns the resource given by the flags of a create or update command, or by its JSON file
+func parseResource(command string, args []string) (client.Resource, error) {
+	var resource client.Resource
+	flags := flag.NewFlagSet("resources "+command, flag.ContinueOnError)
+	file := flags.String("f", "", "JSON file of the resource, instead of the flags")
+	flags.StringVar(&resource.Name, "name", "", "Name of the resource")
+	flags.StringVar(&resource.Algorithm, "algorithm", "", "sliding_window (the default) or token_bucket")
+	flags.IntVar(&resource.RequestCount, "requests", 0, "Number of requests per time frame")
+	flags.IntVar(&resource.TimeFrame, "time-frame", 0, "Time frame in seconds")
+	flags.IntVar(&resource.TimeFrameMs, "time-frame-ms", 0, "Time frame in milliseconds, instead of -time-frame")
+	flags.IntVar(&resource.TokenCount, "tokens", 0, "Number of tokens per time frame")
+	flags.StringVar(&resource.Parent, "parent", "", "Resource whose limits also apply")
+	flags.BoolVar(&resource.Adaptive, "adaptive", false, "Adapt the request count to the feedback of the API")
+	flags.StringVar(&resource.UpstreamURL, "upstream-url", "", "Base URL of the API, for the proxy")
+	flags.IntVar(&resource.BucketCapacity, "capacity", 0, "Capacity of the token bucket")
+	flags.Float64Var(&resource.RefillRate, "refill-rate", 0, "Tokens added to the bucket per second")
+	flags.Float64Var(&resource.HighPriorityShare, "high-priority-share", 0, "Share of the limits kept for high priority calls")
+	flags.Float64Var(&resource.TenantCap, "tenant-cap", 0, "Largest share of the limits a single tenant can use")
+	if err := flags.Parse(args); err != nil {
+		return resource, err
+	}
+
+	if *file != "" {
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			return resource, err
+		}
+		resource = client.Resource{}
+		if err := json.Unmarshal(data, &resource); err != nil {
+			return resource, fmt.Errorf("invalid resource file %s: %w", *file, err)
+		}
+	}
+	if resource.Name == "" {
+		return resource, errors.New("the resource needs a name")
+	}
+	return resource, nil
+}
+
+func runSchedule(ctx context.Context, c *client.Client, p printer, args []string) error {
+	var request client.ScheduleRequest
+	flags := flag.NewFlagSet("schedule", flag.ContinueOnError)
+	flags.StringVar(&request.ResourceName, "resource", "", "Name of the resource")
+	flags.IntVar(&request.NumCalls, "calls", 1, "Number of calls")
+	request.Weight = flags.Int("weight", 1, "Token estimate of every call")
+	flags.BoolVar(&request.DryRun, "dry-run", false, "Only compute the delays, nothing is reserved")
+	flags.IntVar(&request.MaxDelayMs, "max-delay-ms", 0, "Maximum delay of a call in milliseconds")
+	flags.BoolVar(&request.Partial, "partial", false, "Only schedule the calls that fit the maximum delay")
+	flags.StringVar(&request.Priority, "priority", "", "high (the default) or low")
+	flags.StringVar(&request.Tenant, "tenant", "", "Tenant making the calls")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if request.ResourceName == "" {
+		return errors.New("usage: meterflowctl schedule -resource NAME -calls N")
+	}
+
+	schedule, err := c.Schedule(ctx, request)
+	if err != nil {
+		return err
+	}
+	return p.schedule(schedule)
+}
+
+func runStatus(ctx context.Context, c *client.Client, p printer, args []string) error {
+	names := args
+	if len(names) == 0 {
+		resources, err := c.ListResources(ctx)
+		if err != nil {
+			return err
+		}
+		for _, resource := range resources {
+			names = append(names, resource.Name)
+		}
+		slices.Sort(names)
+	}
+
+	statuses := make([]*client.Status, 0, len(names))
+	for _, name := range names {
+		status, err := c.ResourceStatus(ctx, name)
+		if err != nil {
+			return err
+		}
+		statuses = append(statuses, status)
+	}
+	return p.statuses(statuses)
+}
+
+// runExport writes the settings of every resource as a JSON array, which import takes back
+func runExport(ctx context.Context, c *client.Client, out io.Writer, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	file := flags.String("f", "", "File to write, stdout if empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	resources, err := c.ListResources(ctx)
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(resources, func(a, b client.Resource) int { return strings.Compare(a.Name, b.Name) })
+	for i := range resources {
+		// Learned at runtime, not a setting
+		resources[i].EffectiveRequestCount = 0
+	}
+
+	data, err := json.MarshalIndent(resources, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if *file == "" {
+		_, err = out.Write(data)
+		return err
+	}
+	return os.WriteFile(*file, data, 0644)
+}
+
+// runImport creates the resources of an exported file, and updates the ones already registered. The parents are
+// imported before their children.
+func runImport(ctx context.Context, c *client.Client, out io.Writer, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	file := flags.String("f", "", "File written by export")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("usage: meterflowctl import -f FILE")
+	}
+
+	data, err := os.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+	var resources []client.Resource
+	if err := json.Unmarshal(data, &resources); err != nil {
+		return fmt.Errorf("invalid resources file %s: %w", *file, err)
+	}
+
+	created, updated := 0, 0
+	for _, resource := range parentsFirst(resources) {
+		err := c.RegisterResource(ctx, resource)
+		var e *client.Error
+		if errors.As(err, &e) && e.StatusCode == http.StatusConflict {
+			err = c.UpdateResource(ctx, resource)
+			updated++
+		} else {
+			created++
+		}
+		if err != nil {
+			return fmt.Errorf("resource %s: %w", resource.Name, err)
+		}
+	}
+	fmt.Fprintf(out, "%d resources created, %d updated\n", created, updated)
+	return nil
+}
+
+// parentsFirst orders the resources so that each parent comes before its children
+func parentsFirst(resources []client.Resource) []client.Resource {
+	byName := make(map[string]client.Resource, len(resources))
+	for _, resource := range resources {
+		byName[resource.Name] = resource
+	}
+
+	ordered := make([]client.Resource, 0, len(resources))
+	added := make(map[string]bool, len(resources))
+	var add func(resource client.Resource)
+	add = func(resource client.Resource) {
+		if added[resource.Name] {
+			return
+		}
+		added[resource.Name] = true
+		if parent, ok := byName[resource.Parent]; ok {
+			add(parent)
+		}
+		ordered = append(ordered, resource)
+	}
+	for _, resource := range resources {
+		add(resource)
+	}
+	return ordered
+}
@@ -0,0 +1,290 @@
+package dispatch
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// States of a job
+const (
+	StatusScheduled = "scheduled" // Waiting for its slot
+	StatusRunning   = "running"   // The request is being sent
+	StatusCompleted = "completed" // The API answered, the result holds its response
+	StatusFailed    = "failed"    // Every attempt failed, the result holds the last error or response
+	StatusCancelled = "cancelled" // Cancelled before its request was sent
+)
+
+// Maximum size of a response body kept in a result, the rest is dropped
+const maxResultBody = 1 << 20
+
+// Request is an HTTP request to send to a rate limited API
+type Request struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// Result is the outcome of the last attempt of a job
+type Result struct {
+	StatusCode int               `json:"status_code,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Body       string            `json:"body,omitempty"`
+	Error      string            `json:"error,omitempty"` // Set when no response was received
+}
+
+// Job is a request sent by MeterFlow on a slot of a resource, with its state
+type Job struct {
+	ID           string  `json:"id"`
+	ResourceName string  `json:"resource_name"`
+	Request      Request `json:"request"`
+	Weight       int     `json:"weight,omitempty"`   // Token estimate of the call
+	Priority     string  `json:"priority,omitempty"` // Priority of the slots of the job, high if empty
+	Tenant       string  `json:"tenant,omitempty"`   // Tenant the slots of the job are scheduled for, if any
+	CallbackURL  string  `json:"callback_url,omitempty"`
+	MaxAttempts  int     `json:"max_attempts"`
+
+	Status      string  `json:"status"`
+	Attempts    int     `json:"attempts"`
+	ScheduledAt int64   `json:"scheduled_at"`          // Unix timestamp (in milliseconds) of the next or last attempt
+	Reservation string  `json:"reservation,omitempty"` // Reservation of the slot of the next or last attempt
+	Result      *Result `json:"result,omitempty"`
+}
+
+// Slots reserves the slots of the jobs on their resources, and tells the resources how the API answered
+type Slots interface {
+	// Schedule reserves a slot for the next attempt of the job, and returns its delay in milliseconds and its reservation
+	Schedule(job Job) (int, string, error)
+	// Release gives back the slot of a reservation whose call won't be made
+	Release(reservation string) error
+	// Feedback reports the response of the API to an attempt, and returns the Unix timestamp (in milliseconds) before
+	// which the resource must not be called again, 0 if none
+	Feedback(job Job, result Result) int64
+}
+
+// Dispatcher sends the requests of the jobs at the time of their slots, and keeps their results for polling
+type Dispatcher struct {
+	Backoff    time.Duration // Wait before the first retry of a failed attempt, doubled for each following one
+	MaxBackoff time.Duration // Longest wait before a retry, the doubling stops there
+	Retention  time.Duration // How long the finished jobs are kept
+
+	client *http.Client
+	slots  Slots
+	mutex  sync.Mutex // Guards the jobs and timers maps and the jobs they hold
+	jobs   map[string]*Job
+	timers map[string]*time.Timer // Timer of the next step of each job waiting for its slot or its retry
+}
+
+func NewDispatcher(client *http.Client, slots Slots) *Dispatcher {
+	return &Dispatcher{
+		Backoff:    time.Second,
+		MaxBackoff: 5 * time.Minute,
+		Retention:  time.Hour,
+		client:     client,
+		slots:      slots,
+		jobs:       make(map[string]*Job),
+		timers:     make(map[string]*time.Timer),
+	}
+}
+
+// NewJobID returns a random job ID, distinct from the reservation IDs
+func NewJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return "job_" + hex.EncodeToString(b)
+}
+
+// Submit adds a job whose first slot was already reserved, its request is sent after the delay (in milliseconds)
+func (d *Dispatcher) Submit(job Job, delay int) {
+	job.Status = StatusScheduled
+	job.ScheduledAt = time.Now().UnixMilli() + int64(delay)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.jobs[job.ID] = &job
+	d.timers[job.ID] = time.AfterFunc(time.Duration(delay)*time.Millisecond, func() { d.run(job.ID) })
+}
+
+// Job returns a copy of the job with the given ID
+func (d *Dispatcher) Job(id string) (Job, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	job, exists := d.jobs[id]
+	if !exists {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Cancel cancels a job waiting for its slot or its retry, and gives its reserved slot back. It returns false as its last value
+// if the job is being sent or already finished.
+func (d *Dispatcher) Cancel(id string) (Job, bool, bool) {
+	d.mutex.Lock()
+	job, exists := d.jobs[id]
+	if !exists {
+		d.mutex.Unlock()
+		return Job{}, false, false
+	}
+	timer := d.timers[id]
+	if job.Status != StatusScheduled || timer == nil || !timer.Stop() {
+		cancelled := *job
+		d.mutex.Unlock()
+		return cancelled, true, false
+	}
+	delete(d.timers, id)
+	job.Status = StatusCancelled
+	cancelled := *job
+	d.mutex.Unlock()
+
+	d.release(cancelled)
+	d.finish(cancelled)
+	return cancelled, true, true
+}
+
+// run makes an attempt of the job, and either retries it later or finishes it
+func (d *Dispatcher) run(id string) {
+	d.mutex.Lock()
+	delete(d.timers, id)
+	job := d.jobs[id]
+	job.Status = StatusRunning
+	job.Attempts++
+	attempt := *job
+	d.mutex.Unlock()
+
+	result := d.send(attempt.Request)
+	retry := result.Error != "" || result.StatusCode == http.StatusTooManyRequests || result.StatusCode >= 500
+
+	// A call that didn't reach the API or that it throttled isn't counted by the API, its slot is given back
+	if result.Error != "" || result.StatusCode == http.StatusTooManyRequests {
+		d.release(attempt)
+	}
+	// The resource follows the response, a throttled call pauses it
+	var retryAt int64
+	if result.StatusCode != 0 {
+		retryAt = d.slots.Feedback(attempt, result)
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	job.Result = &result
+	if !retry {
+		job.Status = StatusCompleted
+	} else if job.Attempts >= job.MaxAttempts {
+		job.Status = StatusFailed
+	} else {
+		job.Status = StatusScheduled
+		// The slot of the attempt is spent, the next one is reserved after the wait
+		job.Reservation = ""
+	}
+
+	if job.Status == StatusScheduled {
+		// Wait for the backoff, and for the end of the pause asked by the API, before reserving the slot of the next attempt
+		wait := max(d.backoff(job.Attempts), time.Duration(retryAt-time.Now().UnixMilli())*time.Millisecond)
+		d.timers[id] = time.AfterFunc(wait, func() { d.retry(id) })
+		return
+	}
+	go d.finish(*job)
+}
+
+// backoff returns the wait before retrying a job after its failed attempts, doubled for each of them up to the maximum
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	wait := d.Backoff
+	for i := 1; i < attempts && wait < d.MaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, d.MaxBackoff)
+}
+
+// retry reserves a slot for the next attempt of the job, the job fails if none can be reserved
+func (d *Dispatcher) retry(id string) {
+	job, _ := d.Job(id)
+	delay, reservation, err := d.slots.Schedule(job)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.timers, id)
+	if err != nil {
+		d.jobs[id].Status = StatusFailed
+		d.jobs[id].Reservation = ""
+		d.jobs[id].Result = &Result{Error: err.Error()}
+		go d.finish(*d.jobs[id])
+		return
+	}
+	d.jobs[id].ScheduledAt = time.Now().UnixMilli() + int64(delay)
+	d.jobs[id].Reservation = reservation
+	d.timers[id] = time.AfterFunc(time.Duration(delay)*time.Millisecond, func() { d.run(id) })
+}
+
+// release gives back the slot reserved for the job, if any
+func (d *Dispatcher) release(job Job) {
+	if job.Reservation == "" {
+		return
+	}
+	if err := d.slots.Release(job.Reservation); err != nil {
+		log.Printf("Error releasing reservation %s of job %s: %v", job.Reservation, job.ID, err)
+	}
+}
+
+// finish delivers the finished job to its callback URL, if any, and forgets it once it was kept long enough
+func (d *Dispatcher) finish(job Job) {
+	time.AfterFunc(d.Retention, func() {
+		d.mutex.Lock()
+		delete(d.jobs, job.ID)
+		d.mutex.Unlock()
+	})
+
+	if job.CallbackURL == "" {
+		return
+	}
+	body, err := json.Marshal(job)
+	if err != nil {
+		log.Printf("Error encoding job %s: %v", job.ID, err)
+		return
+	}
+	resp, err := d.client.Post(job.CallbackURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error delivering job %s to %s: %v", job.ID, job.CallbackURL, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// send sends the request and returns the response as a result
+func (d *Dispatcher) send(request Request) Result {
+	req, err := http.NewRequest(request.Method, request.URL, strings.NewReader(request.Body))
+	if err != nil {
+		return Result{Error: err.Error()}
+	}
+	for key, value := range request.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return Result{Error: err.Error()}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResultBody))
+	if err != nil {
+		return Result{Error: err.Error()}
+	}
+	result := Result{
+		StatusCode: resp.StatusCode,
+		Headers:    make(map[string]string, len(resp.Header)),
+		Body:       string(body),
+	}
+	for key := range resp.Header {
+		result.Headers[key] = resp.Header.Get(key)
+	}
+	return result
+}
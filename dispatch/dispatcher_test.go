@@ -0,0 +1,260 @@
+package dispatch
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSlots reserves every slot without delay, and records the reservations released and the responses reported
+type testSlots struct {
+	mutex     sync.Mutex
+	scheduled int
+	released  []string
+	feedback  []int
+	pause     time.Duration // Pause asked by a throttled call
+}
+
+func (s *testSlots) Schedule(job Job) (int, string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.scheduled++
+	return 0, fmt.Sprintf("test_reservation_%d", s.scheduled), nil
+}
+
+func (s *testSlots) Release(reservation string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.released = append(s.released, reservation)
+	return nil
+}
+
+func (s *testSlots) Feedback(job Job, result Result) int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.feedback = append(s.feedback, result.StatusCode)
+	if result.StatusCode == http.StatusTooManyRequests {
+		return time.Now().Add(s.pause).UnixMilli()
+	}
+	return 0
+}
+
+func TestDispatcher(t *testing.T) {
+	// Test cases
+	testCases := []struct {
+		name             string
+		statusCodes      []int // Status code of each attempt, the last one is repeated
+		maxAttempts      int
+		expectedStatus   string
+		expectedAttempts int
+		expectedCode     int
+		expectedReleased []string // Reservations given back, of the throttled attempts
+	}{
+		{
+			name:             "Completed on first attempt",
+			statusCodes:      []int{http.StatusOK},
+			maxAttempts:      3,
+			expectedStatus:   StatusCompleted,
+			expectedAttempts: 1,
+			expectedCode:     http.StatusOK,
+		},
+		{
+			name:             "Retried after a server error and a throttled call",
+			statusCodes:      []int{http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusOK},
+			maxAttempts:      3,
+			expectedStatus:   StatusCompleted,
+			expectedAttempts: 3,
+			expectedCode:     http.StatusOK,
+			expectedReleased: []string{"test_reservation_1"},
+		},
+		{
+			name:             "Failed after every attempt",
+			statusCodes:      []int{http.StatusBadGateway},
+			maxAttempts:      2,
+			expectedStatus:   StatusFailed,
+			expectedAttempts: 2,
+			expectedCode:     http.StatusBadGateway,
+		},
+		{
+			name:             "Client error not retried",
+			statusCodes:      []int{http.StatusNotFound},
+			maxAttempts:      3,
+			expectedStatus:   StatusCompleted,
+			expectedAttempts: 1,
+			expectedCode:     http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// The API answers with the status codes in turn
+			attempts := 0
+			api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.statusCodes[min(attempts, len(tc.statusCodes)-1)])
+				attempts++
+			}))
+			defer api.Close()
+
+			// The finished job is delivered to the callback
+			callbacks := make(chan Job, 1)
+			callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var job Job
+				if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+					t.Errorf("failed to decode callback body: %v", err)
+				}
+				callbacks <- job
+			}))
+			defer callback.Close()
+
+			slots := &testSlots{}
+			dispatcher := NewDispatcher(http.DefaultClient, slots)
+			dispatcher.Backoff = time.Millisecond
+
+			dispatcher.Submit(Job{
+				ID:          "test_job",
+				Reservation: "test_reservation_0",
+				Request:     Request{Method: "POST", URL: api.URL, Body: "{}"},
+				CallbackURL: callback.URL,
+				MaxAttempts: tc.maxAttempts,
+			}, 0)
+
+			select {
+			case job := <-callbacks:
+				if job.Status != tc.expectedStatus || job.Attempts != tc.expectedAttempts || job.Result.StatusCode != tc.expectedCode {
+					t.Errorf("expected %s after %d attempts with %d, got %s after %d attempts with %d",
+						tc.expectedStatus, tc.expectedAttempts, tc.expectedCode, job.Status, job.Attempts, job.Result.StatusCode)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the job to be delivered to the callback")
+			}
+
+			// A slot is reserved for each retry, each response is reported, and the job is kept for polling
+			slots.mutex.Lock()
+			defer slots.mutex.Unlock()
+			if slots.scheduled != tc.expectedAttempts-1 {
+				t.Errorf("expected %d slots reserved for retries, got %d", tc.expectedAttempts-1, slots.scheduled)
+			}
+			if !slices.Equal(slots.released, tc.expectedReleased) {
+				t.Errorf("expected reservations %v released, got %v", tc.expectedReleased, slots.released)
+			}
+			if len(slots.feedback) != tc.expectedAttempts {
+				t.Errorf("expected %d responses reported, got %v", tc.expectedAttempts, slots.feedback)
+			}
+			if job, exists := dispatcher.Job("test_job"); !exists || job.Status != tc.expectedStatus {
+				t.Errorf("expected the job to be kept with status %s", tc.expectedStatus)
+			}
+		})
+	}
+}
+
+func TestDispatcherRetryAfter(t *testing.T) {
+	// The API throttles the first call and asks to wait
+	var calls []time.Time
+	var mutex sync.Mutex
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		calls = append(calls, time.Now())
+		if len(calls) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer api.Close()
+
+	slots := &testSlots{pause: 200 * time.Millisecond}
+	dispatcher := NewDispatcher(http.DefaultClient, slots)
+	dispatcher.Backoff = time.Millisecond
+	dispatcher.Submit(Job{ID: "test_job", Request: Request{Method: "GET", URL: api.URL}, MaxAttempts: 2}, 0)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, _ := dispatcher.Job("test_job")
+		if job.Status == StatusCompleted {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the job to complete, got %s", job.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The retry waited for the pause rather than the backoff
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(calls) != 2 || calls[1].Sub(calls[0]) < 150*time.Millisecond {
+		t.Errorf("expected the retry to wait for the pause, got %d calls", len(calls))
+	}
+}
+
+func TestDispatcherCancel(t *testing.T) {
+	slots := &testSlots{}
+	dispatcher := NewDispatcher(http.DefaultClient, slots)
+	dispatcher.Submit(Job{
+		ID:          "test_job",
+		Reservation: "test_reservation_0",
+		Request:     Request{Method: "GET", URL: "http://localhost"},
+		MaxAttempts: 1,
+	}, 3600000)
+
+	// The job waiting for its slot is cancelled, and its slot is given back
+	job, exists, cancelled := dispatcher.Cancel("test_job")
+	if !exists || !cancelled || job.Status != StatusCancelled {
+		t.Fatalf("expected the job to be cancelled, got %v %v %s", exists, cancelled, job.Status)
+	}
+	if !slices.Equal(slots.released, []string{"test_reservation_0"}) {
+		t.Errorf("expected the reservation to be released, got %v", slots.released)
+	}
+
+	// A finished job can't be cancelled again
+	if _, exists, cancelled := dispatcher.Cancel("test_job"); !exists || cancelled {
+		t.Errorf("expected the cancelled job to be kept and not cancelled again")
+	}
+	if _, exists, _ := dispatcher.Cancel("unknown_job"); exists {
+		t.Errorf("expected an unknown job not to exist")
+	}
+}
+
+func TestDispatcherBackoff(t *testing.T) {
+	dispatcher := NewDispatcher(http.DefaultClient, nil)
+
+	// Test cases
+	testCases := []struct {
+		name            string
+		attempts        int
+		expectedBackoff time.Duration
+	}{
+		{
+			name:            "First retry",
+			attempts:        1,
+			expectedBackoff: time.Second,
+		},
+		{
+			name:            "Doubled for each retry",
+			attempts:        4,
+			expectedBackoff: 8 * time.Second,
+		},
+		{
+			name:            "Capped at the maximum",
+			attempts:        10,
+			expectedBackoff: 5 * time.Minute,
+		},
+		{
+			name:            "Many attempts don't overflow",
+			attempts:        100,
+			expectedBackoff: 5 * time.Minute,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if backoff := dispatcher.backoff(tc.attempts); backoff != tc.expectedBackoff {
+				t.Errorf("expected a backoff of %v, got %v", tc.expectedBackoff, backoff)
+			}
+		})
+	}
+}
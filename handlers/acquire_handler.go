@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"meter_flow/metrics"
+	"meter_flow/model"
+	"meter_flow/server"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// AcquireSlot reserves a slot for a single call and holds the request open until the call can be made.
+// If the client disconnects while waiting, the slot is given back to the resource.
+func AcquireSlot(srv *server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data struct {
+			ResourceName string `json:"resource_name"`
+			Weight       *int   `json:"weight"`      // Token estimate of the call, 1 if missing
+			MaxWaitMs    int    `json:"max_wait_ms"` // Maximum time to wait for a slot, 0 for no maximum
+			Priority     string `json:"priority"`    // "high" (the default) or "low"
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || callWeight(data.Weight) < 0 || data.MaxWaitMs < 0 || !validPriority(data.Priority) {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		// The call is only reserved if the wait is acceptable
+		chain, err := resourceChain(srv, data.ResourceName)
+		if err != nil {
+			storageUnavailable(w, err)
+			return
+		}
+		now := time.Now().UnixMilli()
+		weight := callWeight(data.Weight)
+		delay, exists, tooHeavy, err := reserveSlot(srv, chain, weight, data.Priority, data.MaxWaitMs, now)
+		if err != nil {
+			storageUnavailable(w, err)
+			return
+		}
+		if !exists {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+		if tooHeavy {
+			http.Error(w, "Weight exceeds the token count of the resource", http.StatusBadRequest)
+			return
+		}
+		if data.MaxWaitMs > 0 && delay > data.MaxWaitMs {
+			w.Header().Set("Retry-After", strconv.Itoa(delaysInSeconds([]int{delay})[0]))
+			http.Error(w, "No slot available within the maximum wait", http.StatusTooManyRequests)
+			return
+		}
+		metrics.ObserveSchedule(data.ResourceName, []int{delay})
+
+		timer := time.NewTimer(time.Duration(delay) * time.Millisecond)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"waited_ms": delay,
+			})
+		case <-r.Context().Done():
+			// The client is gone, give the slot back
+			releaseSlot(srv, chain, now+int64(delay), weight)
+		}
+	}
+}
+
+// reserveSlot schedules a single call on a resource and its ancestors (the chain), and returns its delay in
+// milliseconds. The call is only reserved if its delay is at most the maximum wait, 0 for no maximum. The mutexes of
+// the resources are only held while reserving, not while waiting for the slot.
+func reserveSlot(srv *server.Server, chain []string, weight int, priority string, maxWaitMs int, now int64) (int, bool, bool, error) {
+	defer lockResources(srv, chain)()
+
+	weights := []int{weight}
+	delay := 0
+	tooHeavy := false
+	exists, err := srv.UpdateResources(chain, func(resources []*model.Resource) bool {
+		if tooHeavy = exceedsTokenCount(resources, weights); tooHeavy {
+			return false
+		}
+		delay = scheduleResource(resources, weights, priority, "", now, nil)[0]
+		return maxWaitMs == 0 || delay <= maxWaitMs
+	})
+	return delay, exists, tooHeavy, err
+}
+
+// releaseSlot gives back the slot of a call reserved by reserveSlot, when the call won't be made
+func releaseSlot(srv *server.Server, chain []string, at int64, weight int) {
+	defer lockResources(srv, chain)()
+	_, err := srv.UpdateResources(chain, func(resources []*model.Resource) bool {
+		releaseCall(resources, at, weight)
+		return true
+	})
+	if err != nil {
+		log.Printf("Error releasing a slot of resource %s: %v", chain[0], err)
+	}
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"meter_flow/server"
+	"meter_flow/storage"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAcquireSlot(t *testing.T) {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+
+	// An API limited to 1 request every 100 milliseconds
+	registerTestResourceBody(t, server, `{"name":"test_ms", "request_count":1, "time_frame_ms":100}`)
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		requestBody    string
+		expectedStatus int
+		expectedOutput string
+		minWait        time.Duration
+	}{
+		{
+			name:           "Immediate slot",
+			requestBody:    `{"resource_name":"test_ms"}`,
+			expectedStatus: http.StatusOK,
+			expectedOutput: "{\"waited_ms\":0}\n",
+		},
+		{
+			name:           "Slot exceeding the maximum wait",
+			requestBody:    `{"resource_name":"test_ms", "max_wait_ms":10}`,
+			expectedStatus: http.StatusTooManyRequests,
+			expectedOutput: "No slot available within the maximum wait\n",
+		},
+		{
+			name:           "Waiting for a slot",
+			requestBody:    `{"resource_name":"test_ms", "max_wait_ms":1000}`,
+			expectedStatus: http.StatusOK,
+			minWait:        50 * time.Millisecond,
+		},
+		{
+			name:           "Resource not found",
+			requestBody:    `{"resource_name":"non_existent_resource"}`,
+			expectedStatus: http.StatusNotFound,
+			expectedOutput: "Resource not found\n",
+		},
+		{
+			name:           "Invalid request",
+			requestBody:    `{"resource_name":"test_ms", "max_wait_ms":-1}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedOutput: "Invalid request\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Create a new HTTP request
+			req, err := http.NewRequest("POST", "/acquire", bytes.NewBufferString(tc.requestBody))
+			if err != nil {
+				t.Errorf("failed to create request: %v", err)
+			}
+
+			// Create a new HTTP recorder
+			rr := httptest.NewRecorder()
+
+			// Call the acquireSlot handler
+			start := time.Now()
+			handler := AcquireSlot(server)
+			handler(rr, req)
+
+			// Check the response status code
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tc.expectedStatus, rr.Code)
+			}
+
+			// Check the response body if expected
+			if tc.expectedOutput != "" && rr.Body.String() != tc.expectedOutput {
+				t.Errorf("expected response body %q, got %q", tc.expectedOutput, rr.Body.String())
+			}
+
+			// Check that the request was held open
+			if waited := time.Since(start); waited < tc.minWait {
+				t.Errorf("expected to wait at least %v, waited %v", tc.minWait, waited)
+			}
+		})
+	}
+}
+
+func TestAcquireSlotCancelled(t *testing.T) {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+
+	// An API limited to 1 request per minute, with its only slot already used
+	registerTestResourceBody(t, server, `{"name":"test_resource", "request_count":1, "time_frame":60}`)
+	resource := server.Resources["test_resource"]
+	resource.ScheduledCalls = []int64{time.Now().UnixMilli()}
+	server.Resources["test_resource"] = resource
+
+	// The client gives up while waiting for the next slot
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", "/acquire", bytes.NewBufferString(`{"resource_name":"test_resource"}`))
+	if err != nil {
+		t.Errorf("failed to create request: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := AcquireSlot(server)
+	handler(rr, req)
+
+	// The reserved slot is given back
+	if calls := server.Resources["test_resource"].ScheduledCalls; len(calls) != 1 {
+		t.Errorf("expected the cancelled call to be released, got %d scheduled calls", len(calls))
+	}
+}
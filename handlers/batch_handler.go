@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"encoding/json"
+	"meter_flow/metrics"
+	"meter_flow/model"
+	"meter_flow/server"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// batchItem is the calls to schedule on one resource of a batch
+type batchItem struct {
+	ResourceName string `json:"resource_name"`
+	NumCalls     int    `json:"num_calls"`
+	Weight       *int   `json:"weight"`   // Token estimate for every call, 1 if missing
+	Weights      []int  `json:"weights"`  // Token estimate of each call, num_calls can be omitted
+	Priority     string `json:"priority"` // "high" (the default) or "low"
+	Tenant       string `json:"tenant"`   // Team or client sharing the resource with others
+}
+
+// ScheduleBatch schedules calls on several resources at once, for instance the steps of a pipeline calling an embedding
+// API, then a chat API. Either the calls of every item are reserved, or none is.
+func ScheduleBatch(srv *server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data struct {
+			Items   []batchItem `json:"items"`
+			Aligned bool        `json:"aligned"` // Keep each call of an item after the same call of the previous item
+			DryRun  bool        `json:"dry_run"` // Only compute the delays, nothing is reserved
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || len(data.Items) == 0 {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		itemWeights := make([][]int, len(data.Items))
+		for i, item := range data.Items {
+			weights, ok := callWeights(item.NumCalls, callWeight(item.Weight), item.Weights)
+			if !ok || (item.Weight != nil && len(item.Weights) > 0) || !validPriority(item.Priority) {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+			itemWeights[i] = weights
+		}
+
+		// Get the chain of each item, the mutexes of all the resources are locked together
+		chains := make([][]string, len(data.Items))
+		var names []string
+		for i, item := range data.Items {
+			chain, err := resourceChain(srv, item.ResourceName)
+			if err != nil {
+				storageUnavailable(w, err)
+				return
+			}
+			chains[i] = chain
+			for _, name := range chain {
+				if !slices.Contains(names, name) {
+					names = append(names, name)
+				}
+			}
+		}
+		defer lockResources(srv, names)()
+
+		// The items are scheduled in order, each one counting the calls of the previous ones
+		now := time.Now().UnixMilli()
+		itemDelays := make([][]int, len(data.Items))
+		itemReservations := make([][]string, len(data.Items))
+		tooHeavy := false
+		exists, err := srv.UpdateResources(names, func(resources []*model.Resource) bool {
+			byName := make(map[string]*model.Resource, len(names))
+			for i, name := range names {
+				byName[name] = resources[i]
+			}
+
+			chainResources := make([][]*model.Resource, len(data.Items))
+			for i, item := range data.Items {
+				for _, name := range chains[i] {
+					chainResources[i] = append(chainResources[i], byName[name])
+				}
+				if tooHeavy = exceedsTokenCount(chainResources[i], itemWeights[i]); tooHeavy {
+					return false
+				}
+
+				var minDelays []int
+				if data.Aligned && i > 0 {
+					minDelays = alignedDelays(itemDelays[i-1], len(itemWeights[i]))
+				}
+				itemDelays[i] = scheduleResource(chainResources[i], itemWeights[i], item.Priority, item.Tenant, now, minDelays)
+			}
+			if data.DryRun {
+				return false
+			}
+
+			for i, item := range data.Items {
+				itemReservations[i] = reserveCalls(chainResources[i][0], itemWeights[i], itemDelays[i], item.Tenant, now)
+			}
+			return true
+		})
+		if err != nil {
+			storageUnavailable(w, err)
+			return
+		}
+		if !exists {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+		if tooHeavy {
+			http.Error(w, "Weight exceeds the token count of the resource", http.StatusBadRequest)
+			return
+		}
+
+		items := make([]map[string]interface{}, len(data.Items))
+		for i, item := range data.Items {
+			items[i] = map[string]interface{}{
+				"resource_name": item.ResourceName,
+				"delays":        delaysInSeconds(itemDelays[i]),
+				"delays_ms":     itemDelays[i],
+			}
+			if !data.DryRun {
+				metrics.ObserveSchedule(item.ResourceName, itemDelays[i])
+				items[i]["reservations"] = itemReservations[i]
+			}
+		}
+		response := map[string]interface{}{
+			"items": items,
+		}
+		if data.DryRun {
+			response["dry_run"] = true
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// alignedDelays returns the minimum delay of each of the calls of an item, so that none is made before the call with
+// the same index in the previous item. The calls beyond the ones of the previous item wait for its last call.
+func alignedDelays(previous []int, numCalls int) []int {
+	minDelays := make([]int, numCalls)
+	for i := range minDelays {
+		minDelays[i] = previous[min(i, len(previous)-1)]
+	}
+	return minDelays
+}
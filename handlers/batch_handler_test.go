@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"meter_flow/server"
+	"meter_flow/storage"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestScheduleBatch(t *testing.T) {
+	// Test cases, each one on new resources
+	testCases := []struct {
+		name              string
+		requestBody       string
+		expectedStatus    int
+		expectedDelays    [][]int
+		expectedChatCalls int
+	}{
+		{
+			name:              "Aligned pipeline",
+			requestBody:       `{"items":[{"resource_name":"test_chat", "num_calls":2}, {"resource_name":"test_embedding", "num_calls":2}], "aligned":true}`,
+			expectedStatus:    http.StatusOK,
+			expectedDelays:    [][]int{{0, 60000}, {0, 60000}},
+			expectedChatCalls: 2,
+		},
+		{
+			name:              "Unaligned pipeline",
+			requestBody:       `{"items":[{"resource_name":"test_chat", "num_calls":2}, {"resource_name":"test_embedding", "num_calls":2}]}`,
+			expectedStatus:    http.StatusOK,
+			expectedDelays:    [][]int{{0, 60000}, {0, 0}},
+			expectedChatCalls: 2,
+		},
+		{
+			name:              "Same resource in several items",
+			requestBody:       `{"items":[{"resource_name":"test_chat", "num_calls":1}, {"resource_name":"test_chat", "num_calls":1}]}`,
+			expectedStatus:    http.StatusOK,
+			expectedDelays:    [][]int{{0}, {60000}},
+			expectedChatCalls: 2,
+		},
+		{
+			name:              "Dry run",
+			requestBody:       `{"items":[{"resource_name":"test_chat", "num_calls":2}], "dry_run":true}`,
+			expectedStatus:    http.StatusOK,
+			expectedDelays:    [][]int{{0, 60000}},
+			expectedChatCalls: 0,
+		},
+		{
+			name:              "Unknown resource reserves nothing",
+			requestBody:       `{"items":[{"resource_name":"test_chat", "num_calls":2}, {"resource_name":"non_existent_resource", "num_calls":1}]}`,
+			expectedStatus:    http.StatusNotFound,
+			expectedChatCalls: 0,
+		},
+		{
+			name:              "No items",
+			requestBody:       `{"items":[]}`,
+			expectedStatus:    http.StatusBadRequest,
+			expectedChatCalls: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			storage := storage.NewDummyStorage()
+			server := server.NewServer(storage)
+			registerTestResourceBody(t, server, `{"name":"test_chat", "request_count":1, "time_frame":60}`)
+			registerTestResourceBody(t, server, `{"name":"test_embedding", "request_count":10, "time_frame":60}`)
+
+			// Create a new HTTP request
+			req, err := http.NewRequest("POST", "/schedule/batch", bytes.NewBufferString(tc.requestBody))
+			if err != nil {
+				t.Errorf("failed to create request: %v", err)
+			}
+
+			// Create a new HTTP recorder
+			rr := httptest.NewRecorder()
+
+			// Call the scheduleBatch handler
+			handler := ScheduleBatch(server)
+			handler(rr, req)
+
+			// Check the response status code
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tc.expectedStatus, rr.Code)
+			}
+
+			if tc.expectedStatus == http.StatusOK {
+				var response struct {
+					Items []struct {
+						DelaysMs []int `json:"delays_ms"`
+					} `json:"items"`
+				}
+				if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+					t.Errorf("failed to decode response body: %v", err)
+				}
+				var delays [][]int
+				for _, item := range response.Items {
+					delays = append(delays, item.DelaysMs)
+				}
+				if !reflect.DeepEqual(delays, tc.expectedDelays) {
+					t.Errorf("expected delays %v, got %v", tc.expectedDelays, delays)
+				}
+			}
+
+			// The calls are only reserved if every item was scheduled
+			if calls := len(server.Resources["test_chat"].ScheduledCalls); calls != tc.expectedChatCalls {
+				t.Errorf("expected %d calls scheduled on test_chat, got %d", tc.expectedChatCalls, calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"encoding/json"
+	"math"
+	"meter_flow/model"
+	"meter_flow/scheduler"
+	"meter_flow/server"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ResourceFeedback lets clients report how the API answered their calls, so that the schedule follows the actual
+// limits of the API. A throttled call (429) or a Retry-After header pauses the resource, moving the calls already
+// scheduled during the pause after it. An x-ratelimit-remaining header lower than the calls left in the current window
+// means that other clients use the API too, their calls are then counted in the window. The request count of an
+// adaptive resource goes down on throttled calls and up on successful ones.
+func ResourceFeedback(srv *server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data struct {
+			Status  int               `json:"status"`  // HTTP status code of the API response, for instance 429
+			Headers map[string]string `json:"headers"` // Headers of the API response, only the rate limiting ones are used
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.Status < 0 {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		header := make(http.Header, len(data.Headers))
+		for key, value := range data.Headers {
+			header.Set(key, value)
+		}
+		now := time.Now().UnixMilli()
+		response, ok := parseResponse(data.Status, header, now)
+		if !ok {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		result, exists, err := applyResponse(srv, r.PathValue("name"), response, now)
+		if err != nil {
+			storageUnavailable(w, err)
+			return
+		}
+		if !exists {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+
+		body := map[string]interface{}{
+			"shifted_calls":  result.shifted,
+			"external_calls": result.external,
+		}
+		if result.pausedUntil > now {
+			body["paused_until"] = result.pausedUntil
+		}
+		if result.requestCount > 0 {
+			body["effective_request_count"] = result.requestCount
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(body)
+	}
+}
+
+// apiResponse is what the rate limiting of an API tells about a call: its status code and rate limiting headers
+type apiResponse struct {
+	status        int
+	retryAfter    int64 // Milliseconds to wait before the next call
+	hasRetryAfter bool
+	remaining     int // Calls left in the current window of the API
+	hasRemaining  bool
+}
+
+// feedbackResult is how a resource followed an API response
+type feedbackResult struct {
+	shifted      int   // Calls moved after the pause
+	external     int   // Calls of other clients counted in the window
+	pausedUntil  int64 // Unix timestamp (in milliseconds) of the end of the pause of the resource
+	requestCount int   // Effective request count of an adaptive resource, 0 otherwise
+}
+
+// parseResponse reads the rate limiting headers of an API response. It returns false if a header is invalid.
+func parseResponse(status int, header http.Header, now int64) (apiResponse, bool) {
+	response := apiResponse{status: status}
+	var ok bool
+	if response.retryAfter, response.hasRetryAfter, ok = retryAfterMillis(header, now); !ok {
+		return apiResponse{}, false
+	}
+	if response.remaining, response.hasRemaining, ok = remainingCalls(header); !ok {
+		return apiResponse{}, false
+	}
+	return response, true
+}
+
+// applyResponse updates a resource from an API response: a throttled call or a Retry-After header pauses it, the
+// remaining calls of the API are counted in its window, and an adaptive resource adapts its request count
+func applyResponse(srv *server.Server, name string, response apiResponse, now int64) (feedbackResult, bool, error) {
+	// Get the mutexes of the resource and its ancestors, the calls moved by a pause are moved in all of them
+	chain, err := resourceChain(srv, name)
+	if err != nil {
+		return feedbackResult{}, false, err
+	}
+	defer lockResources(srv, chain)()
+
+	var result feedbackResult
+	exists, err := srv.UpdateResources(chain, func(resources []*model.Resource) bool {
+		resource := resources[0]
+		result = feedbackResult{}
+		changed := false
+		pause, paused := response.retryAfter, response.hasRetryAfter
+		if !paused && response.status == http.StatusTooManyRequests {
+			pause, paused = throttlePause(*resource), true
+		}
+		if paused && now+pause > resource.PausedUntil {
+			result.shifted = pauseResource(resources, now+pause, now)
+			changed = true
+		}
+		if response.hasRemaining {
+			result.external = limitRemaining(resources, response.remaining, now)
+			changed = changed || result.external > 0
+		}
+		if resource.Adaptive {
+			changed = adaptRequestCount(resource, response.status) || changed
+			result.requestCount = resource.EffectiveRequestCount()
+		}
+		result.pausedUntil = resource.PausedUntil
+		return changed
+	})
+	return result, exists, err
+}
+
+// retryAfterMillis returns how long the API asked to wait, from the retry-after-ms header or the Retry-After header
+// (in seconds or as a date). It returns false as its last value if a header is invalid.
+func retryAfterMillis(header http.Header, now int64) (int64, bool, bool) {
+	if value := header.Get("Retry-After-Ms"); value != "" {
+		ms, err := strconv.ParseFloat(value, 64)
+		if err != nil || ms < 0 {
+			return 0, false, false
+		}
+		return int64(math.Ceil(ms)), true, true
+	}
+
+	value := header.Get("Retry-After")
+	if value == "" {
+		return 0, false, true
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+		return int64(math.Ceil(seconds * 1000)), true, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(0, date.UnixMilli()-now), true, true
+	}
+	return 0, false, false
+}
+
+// remainingCalls returns the calls the API still allows in its current window, from the x-ratelimit-remaining header
+// or its x-ratelimit-remaining-requests variant. It returns false as its last value if the header is invalid.
+func remainingCalls(header http.Header) (int, bool, bool) {
+	value := header.Get("X-Ratelimit-Remaining")
+	if value == "" {
+		value = header.Get("X-Ratelimit-Remaining-Requests")
+	}
+	if value == "" {
+		return 0, false, true
+	}
+	remaining, err := strconv.Atoi(value)
+	if err != nil || remaining < 0 {
+		return 0, false, false
+	}
+	return remaining, true, true
+}
+
+// throttlePause returns how long a resource is paused after a throttled call without a Retry-After header:
+// the shortest time frame of its limits, or the time to refill one token of its bucket
+func throttlePause(resource model.Resource) int64 {
+	if resource.Algorithm == model.AlgorithmTokenBucket {
+		return int64(math.Ceil(1000 / resource.RefillRate))
+	}
+
+	shortest := int64(math.MaxInt64)
+	for _, limit := range resource.SlidingWindowLimits() {
+		shortest = min(shortest, limit.TimeFrameMillis())
+	}
+	return shortest
+}
+
+// pauseResource pauses the first resource until the given time, and moves the calls it had scheduled during the
+// pause after it, along with their reservations. It returns the number of calls moved.
+func pauseResource(resources []*model.Resource, until, now int64) int {
+	resource := resources[0]
+	resource.PausedUntil = until
+
+	if resource.Algorithm == model.AlgorithmTokenBucket {
+		// The queued calls wait for the deficit to be paid back, it is deepened by the refill of the pause
+		_, tokens := scheduler.ScheduleTokenBucket(0, resource.BucketCapacity, resource.RefillRate, resource.BucketTokens, resource.BucketUpdated, now)
+		deficit := min(tokens, 0)
+		resource.BucketTokens = deficit - float64(until-now)*resource.RefillRate/1000
+		resource.BucketUpdated = now
+		return int(math.Ceil(-deficit))
+	}
+
+	var calls []int64
+	var weights []int
+	for i, t := range resource.ScheduledCalls {
+		if t > now && t < until {
+			calls = append(calls, t)
+			weights = append(weights, resource.ScheduledTokens[i])
+		}
+	}
+	if len(calls) == 0 {
+		return 0
+	}
+
+	// Release the calls and schedule them again, the pause keeps them after it
+	for i, at := range calls {
+		releaseCall(resources, at, weights[i])
+	}
+	delays := scheduleResource(resources, weights, model.PriorityHigh, "", now, nil)
+	moveReservations(resource, calls, weights, delays, now)
+	return len(calls)
+}
+
+// moveReservations updates the reservations of moved calls with their new time
+func moveReservations(resource *model.Resource, calls []int64, weights, delays []int, now int64) {
+	type call struct {
+		at     int64
+		weight int
+	}
+	ids := make(map[call][]string)
+	for id, reservation := range resource.Reservations {
+		key := call{at: reservation.Timestamp, weight: reservation.Weight}
+		ids[key] = append(ids[key], id)
+	}
+
+	ownReservations(resource, 0)
+	for i, at := range calls {
+		key := call{at: at, weight: weights[i]}
+		if len(ids[key]) == 0 {
+			continue
+		}
+		id := ids[key][0]
+		ids[key] = ids[key][1:]
+
+		reservation := resource.Reservations[id]
+		reservation.Timestamp = now + int64(delays[i])
+		resource.Reservations[id] = reservation
+	}
+}
+
+// limitRemaining counts the calls made by other clients of the API in the resources (the first one and its ancestors),
+// so that only the given number of calls is left in the current window of the first one. It returns the number of
+// calls counted.
+func limitRemaining(resources []*model.Resource, remaining int, now int64) int {
+	resource := resources[0]
+	if resource.Algorithm == model.AlgorithmTokenBucket {
+		_, tokens := scheduler.ScheduleTokenBucket(0, resource.BucketCapacity, resource.RefillRate, resource.BucketTokens, resource.BucketUpdated, now)
+		if tokens <= float64(remaining) {
+			return 0
+		}
+		resource.BucketTokens, resource.BucketUpdated = float64(remaining), now
+		return int(tokens) - remaining
+	}
+
+	status := scheduler.SlidingWindowStatus(resource.SlidingWindowLimits(), resource.ScheduledCalls, resource.ScheduledTokens, now)
+	external := status.Limits[0].Remaining - remaining
+	if external <= 0 {
+		return 0
+	}
+
+	// The calls are made now, without any weight
+	for _, r := range resources {
+		i := sort.Search(len(r.ScheduledCalls), func(i int) bool { return r.ScheduledCalls[i] > now })
+		r.ScheduledCalls = slices.Concat(r.ScheduledCalls[:i], slices.Repeat([]int64{now}, external), r.ScheduledCalls[i:])
+		r.ScheduledTokens = slices.Concat(r.ScheduledTokens[:i], make([]int, external), r.ScheduledTokens[i:])
+	}
+	return external
+}
+
+// adaptRequestCount updates the request count of an adaptive resource from the status code of a call: additive
+// increase on a successful call, multiplicative decrease on a throttled one. It returns whether it changed.
+func adaptRequestCount(resource *model.Resource, status int) bool {
+	requestCount := resource.EffectiveRequestCount()
+	switch {
+	case status == http.StatusTooManyRequests:
+		requestCount = max(1, requestCount/model.AdaptiveDecrease)
+	case status >= 200 && status < 300:
+		requestCount = min(resource.RequestCount, requestCount+model.AdaptiveIncrease)
+	}
+
+	changed := requestCount != resource.EffectiveRequestCount()
+	resource.AdaptiveRequestCount = requestCount
+	return changed
+}
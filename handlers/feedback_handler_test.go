@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"meter_flow/server"
+	"meter_flow/storage"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResourceFeedback(t *testing.T) {
+	// Test cases, each one on a new resource limited to 10 requests per minute
+	testCases := []struct {
+		name           string
+		resourceName   string
+		requestBody    string
+		expectedStatus int
+		expectedDelays []int // Delays of 2 calls scheduled after the feedback
+	}{
+		{
+			name:           "Successful call",
+			resourceName:   "test_resource",
+			requestBody:    `{"status":200}`,
+			expectedStatus: http.StatusOK,
+			expectedDelays: []int{0, 0},
+		},
+		{
+			name:           "Retry-After pauses the resource",
+			resourceName:   "test_resource",
+			requestBody:    `{"status":429, "headers":{"Retry-After":"30"}}`,
+			expectedStatus: http.StatusOK,
+			expectedDelays: []int{30000, 30000},
+		},
+		{
+			name:           "Throttled call without Retry-After",
+			resourceName:   "test_resource",
+			requestBody:    `{"status":429}`,
+			expectedStatus: http.StatusOK,
+			expectedDelays: []int{60000, 60000},
+		},
+		{
+			name:           "Calls of other clients",
+			resourceName:   "test_resource",
+			requestBody:    `{"status":200, "headers":{"x-ratelimit-remaining":"1"}}`,
+			expectedStatus: http.StatusOK,
+			expectedDelays: []int{0, 60000},
+		},
+		{
+			name:           "Invalid Retry-After",
+			resourceName:   "test_resource",
+			requestBody:    `{"status":429, "headers":{"Retry-After":"soon"}}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedDelays: []int{0, 0},
+		},
+		{
+			name:           "Resource not found",
+			resourceName:   "non_existent_resource",
+			requestBody:    `{"status":429}`,
+			expectedStatus: http.StatusNotFound,
+			expectedDelays: []int{0, 0},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			storage := storage.NewDummyStorage()
+			server := server.NewServer(storage)
+			registerTestResource(t, server)
+
+			// Create a new HTTP request
+			req, err := http.NewRequest("POST", "/resources/"+tc.resourceName+"/feedback", bytes.NewBufferString(tc.requestBody))
+			if err != nil {
+				t.Errorf("failed to create request: %v", err)
+			}
+			req.SetPathValue("name", tc.resourceName)
+
+			// Create a new HTTP recorder
+			rr := httptest.NewRecorder()
+
+			// Call the resourceFeedback handler
+			handler := ResourceFeedback(server)
+			handler(rr, req)
+
+			// Check the response status code
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tc.expectedStatus, rr.Code)
+			}
+
+			// Check the delays of the next calls
+			delays, _ := scheduleTestCalls(t, server, `{"resource_name":"test_resource", "num_calls":2}`)
+			if len(delays) != len(tc.expectedDelays) {
+				t.Fatalf("expected delays %v, got %v", tc.expectedDelays, delays)
+			}
+			for i, delay := range delays {
+				if delay > tc.expectedDelays[i] || delay < tc.expectedDelays[i]-1000 {
+					t.Errorf("expected delays %v, got %v", tc.expectedDelays, delays)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestResourceFeedbackShiftsReservations(t *testing.T) {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+
+	// An API limited to 2 requests per minute, with a third call scheduled a minute from now
+	registerTestResourceBody(t, server, `{"name":"test_resource", "request_count":2, "time_frame":60}`)
+	_, reservations := scheduleTestCalls(t, server, `{"resource_name":"test_resource", "num_calls":3}`)
+
+	// The API asks to wait for 90 seconds
+	req, err := http.NewRequest("POST", "/resources/test_resource/feedback", bytes.NewBufferString(`{"status":429, "headers":{"Retry-After":"90"}}`))
+	if err != nil {
+		t.Errorf("failed to create request: %v", err)
+	}
+	req.SetPathValue("name", "test_resource")
+	rr := httptest.NewRecorder()
+	handler := ResourceFeedback(server)
+	handler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	var response struct {
+		PausedUntil  int64 `json:"paused_until"`
+		ShiftedCalls int   `json:"shifted_calls"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Errorf("failed to decode response body: %v", err)
+	}
+	pausedUntil := response.PausedUntil
+	if pausedUntil < time.Now().UnixMilli()+89000 || response.ShiftedCalls != 1 {
+		t.Errorf("expected a pause of 90 seconds and one shifted call, got %+v", response)
+	}
+
+	// The third call is moved after the pause, along with its reservation
+	resource := server.Resources["test_resource"]
+	if last := resource.ScheduledCalls[len(resource.ScheduledCalls)-1]; last < pausedUntil {
+		t.Errorf("expected the last call after the pause, got %d", last)
+	}
+	if reservation := resource.Reservations[reservations[2]]; reservation.Timestamp < pausedUntil {
+		t.Errorf("expected the last reservation after the pause, got %d", reservation.Timestamp)
+	}
+	if reservation := resource.Reservations[reservations[0]]; reservation.Timestamp >= pausedUntil {
+		t.Errorf("expected the first reservation to stay, got %d", reservation.Timestamp)
+	}
+}
+
+func TestResourceFeedbackWAL(t *testing.T) {
+	dir := t.TempDir()
+	snapshotPath, logPath := filepath.Join(dir, "resources.json"), filepath.Join(dir, "resources.wal")
+	server := server.NewServer(storage.NewWALStorage(snapshotPath, logPath))
+
+	// An API limited to 2 requests per minute, with a third call scheduled a minute from now
+	registerTestResourceBody(t, server, `{"name":"test_resource", "request_count":2, "time_frame":60}`)
+	scheduleTestCalls(t, server, `{"resource_name":"test_resource", "num_calls":3}`)
+
+	// A throttled call pauses the resource and moves the third call after the pause
+	req, err := http.NewRequest("POST", "/resources/test_resource/feedback", bytes.NewBufferString(`{"status":429, "headers":{"Retry-After":"90"}}`))
+	if err != nil {
+		t.Errorf("failed to create request: %v", err)
+	}
+	req.SetPathValue("name", "test_resource")
+	rr := httptest.NewRecorder()
+	handler := ResourceFeedback(server)
+	handler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	// Replaying the log gives back the pause and the moved reservation
+	loaded, err := storage.NewWALStorage(snapshotPath, logPath).Load()
+	if err != nil {
+		t.Errorf("failed to load resources: %v", err)
+	}
+	resource, replayed := server.Resources["test_resource"], loaded["test_resource"]
+	if replayed.PausedUntil != resource.PausedUntil {
+		t.Errorf("expected the resource paused until %d, got %d", resource.PausedUntil, replayed.PausedUntil)
+	}
+	if !reflect.DeepEqual(replayed.Reservations, resource.Reservations) {
+		t.Errorf("expected reservations %v, got %v", resource.Reservations, replayed.Reservations)
+	}
+	if !reflect.DeepEqual(replayed.ScheduledCalls, resource.ScheduledCalls) {
+		t.Errorf("expected scheduled calls %v, got %v", resource.ScheduledCalls, replayed.ScheduledCalls)
+	}
+}
+
+func TestResourceFeedbackAdaptive(t *testing.T) {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+
+	// A partner API allowing at most 10 requests per minute, its actual limit is unknown
+	registerTestResourceBody(t, server, `{"name":"test_resource", "request_count":10, "time_frame":60, "adaptive":true}`)
+
+	// Test cases, run in order on the same resource
+	testCases := []struct {
+		name                 string
+		requestBody          string
+		expectedRequestCount int
+	}{
+		{
+			name:                 "Successful call at the ceiling",
+			requestBody:          `{"status":200}`,
+			expectedRequestCount: 10,
+		},
+		{
+			name:                 "Throttled call halves the limit",
+			requestBody:          `{"status":429, "headers":{"Retry-After":"0"}}`,
+			expectedRequestCount: 5,
+		},
+		{
+			name:                 "Successful call adds one request",
+			requestBody:          `{"status":200}`,
+			expectedRequestCount: 6,
+		},
+		{
+			name:                 "Server error is ignored",
+			requestBody:          `{"status":500}`,
+			expectedRequestCount: 6,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", "/resources/test_resource/feedback", bytes.NewBufferString(tc.requestBody))
+			if err != nil {
+				t.Errorf("failed to create request: %v", err)
+			}
+			req.SetPathValue("name", "test_resource")
+			rr := httptest.NewRecorder()
+			handler := ResourceFeedback(server)
+			handler(rr, req)
+
+			var response struct {
+				EffectiveRequestCount int `json:"effective_request_count"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Errorf("failed to decode response body: %v", err)
+			}
+			if response.EffectiveRequestCount != tc.expectedRequestCount {
+				t.Errorf("expected a request count of %d, got %d", tc.expectedRequestCount, response.EffectiveRequestCount)
+			}
+		})
+	}
+
+	// The calls are scheduled with the adapted request count
+	delays, _ := scheduleTestCalls(t, server, `{"resource_name":"test_resource", "num_calls":7}`)
+	if len(delays) != 7 || delays[5] != 0 || delays[6] < 59000 {
+		t.Errorf("expected 6 calls right away and one a minute later, got %v", delays)
+	}
+}
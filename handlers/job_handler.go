@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"meter_flow/dispatch"
+	"meter_flow/metrics"
+	"meter_flow/model"
+	"meter_flow/server"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Number of attempts of a job when the request doesn't give it, and the most a request can ask for
+const (
+	defaultMaxAttempts = 3
+	maxAttempts        = 20
+)
+
+// SubmitJobs schedules HTTP requests on a resource, MeterFlow sends them itself at the time of their slots.
+// The results are delivered to the callback URL, if any, and kept for polling.
+func SubmitJobs(srv *server.Server, dispatcher *dispatch.Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data struct {
+			ResourceName string             `json:"resource_name"`
+			Requests     []dispatch.Request `json:"requests"`
+			Weight       *int               `json:"weight"`       // Token estimate of every request, 1 if missing
+			CallbackURL  string             `json:"callback_url"` // URL the finished jobs are posted to, if any
+			MaxAttempts  int                `json:"max_attempts"` // Attempts of each request before it fails, 3 if missing and 20 at most
+			Priority     string             `json:"priority"`     // "high" (the default) or "low"
+			Tenant       string             `json:"tenant"`       // Team or client sharing the resource with others
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || len(data.Requests) == 0 || callWeight(data.Weight) < 0 || data.MaxAttempts < 0 || data.MaxAttempts > maxAttempts || !validPriority(data.Priority) {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if data.CallbackURL != "" && !validURL(data.CallbackURL) {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		for i, request := range data.Requests {
+			if request.Method == "" {
+				data.Requests[i].Method = http.MethodGet
+			}
+			if !validURL(request.URL) {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+		}
+		if data.MaxAttempts == 0 {
+			data.MaxAttempts = defaultMaxAttempts
+		}
+
+		weights, _ := callWeights(len(data.Requests), callWeight(data.Weight), nil)
+		delays, reservations, exists, tooHeavy, err := scheduleJobCalls(srv, data.ResourceName, weights, data.Priority, data.Tenant)
+		if err != nil {
+			storageUnavailable(w, err)
+			return
+		}
+		if !exists {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+		if tooHeavy {
+			http.Error(w, "Weight exceeds the token count of the resource", http.StatusBadRequest)
+			return
+		}
+		metrics.ObserveSchedule(data.ResourceName, delays)
+
+		jobs := make([]map[string]interface{}, len(data.Requests))
+		for i, request := range data.Requests {
+			job := dispatch.Job{
+				ID:           dispatch.NewJobID(),
+				ResourceName: data.ResourceName,
+				Request:      request,
+				Weight:       weights[i],
+				Priority:     data.Priority,
+				Tenant:       data.Tenant,
+				CallbackURL:  data.CallbackURL,
+				MaxAttempts:  data.MaxAttempts,
+				Reservation:  reservations[i],
+			}
+			dispatcher.Submit(job, delays[i])
+			jobs[i] = map[string]interface{}{
+				"id":       job.ID,
+				"delay_ms": delays[i],
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"jobs": jobs,
+		})
+	}
+}
+
+// JobStatus reports the state of a job, and the response of the API once it answered
+func JobStatus(dispatcher *dispatch.Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, exists := dispatcher.Job(r.PathValue("id"))
+		if !exists {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	}
+}
+
+// CancelJob cancels a job waiting for its slot or its retry, and gives its slot back to the resource
+func CancelJob(dispatcher *dispatch.Dispatcher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, exists, cancelled := dispatcher.Cancel(r.PathValue("id"))
+		if !exists {
+			http.Error(w, "Job not found", http.StatusNotFound)
+			return
+		}
+		if !cancelled {
+			http.Error(w, "Job already "+job.Status, http.StatusConflict)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	}
+}
+
+// JobSlots returns the slots of the jobs on the resources of the server
+func JobSlots(srv *server.Server) dispatch.Slots {
+	return jobSlots{srv: srv}
+}
+
+// jobSlots reserves the slots of the retries of the jobs, and feeds the responses of the API back to their resources
+type jobSlots struct {
+	srv *server.Server
+}
+
+func (s jobSlots) Schedule(job dispatch.Job) (int, string, error) {
+	delays, reservations, exists, tooHeavy, err := scheduleJobCalls(s.srv, job.ResourceName, []int{job.Weight}, job.Priority, job.Tenant)
+	if err != nil {
+		return 0, "", err
+	}
+	if !exists || tooHeavy {
+		return 0, "", fmt.Errorf("resource %s can no longer schedule the job", job.ResourceName)
+	}
+	metrics.ObserveSchedule(job.ResourceName, delays)
+	return delays[0], reservations[0], nil
+}
+
+func (s jobSlots) Release(reservation string) error {
+	_, err := releaseReservation(s.srv, reservation)
+	return err
+}
+
+func (s jobSlots) Feedback(job dispatch.Job, result dispatch.Result) int64 {
+	header := make(http.Header, len(result.Headers))
+	for key, value := range result.Headers {
+		header.Set(key, value)
+	}
+	now := time.Now().UnixMilli()
+	response, ok := parseResponse(result.StatusCode, header, now)
+	if !ok {
+		// Invalid rate limiting headers are ignored, the status code still counts
+		response = apiResponse{status: result.StatusCode}
+	}
+
+	feedback, _, err := applyResponse(s.srv, job.ResourceName, response, now)
+	if err != nil {
+		log.Printf("Error applying the response of job %s to resource %s: %v", job.ID, job.ResourceName, err)
+		return 0
+	}
+	return feedback.pausedUntil
+}
+
+// scheduleJobCalls schedules and reserves the calls of jobs on a resource, and returns their delays in milliseconds
+// and their reservations
+func scheduleJobCalls(srv *server.Server, name string, weights []int, priority, tenant string) ([]int, []string, bool, bool, error) {
+	chain, err := resourceChain(srv, name)
+	if err != nil {
+		return nil, nil, false, false, err
+	}
+	defer lockResources(srv, chain)()
+
+	now := time.Now().UnixMilli()
+	var delays []int
+	var reservations []string
+	tooHeavy := false
+	exists, err := srv.UpdateResources(chain, func(resources []*model.Resource) bool {
+		if tooHeavy = exceedsTokenCount(resources, weights); tooHeavy {
+			return false
+		}
+		delays = scheduleResource(resources, weights, priority, tenant, now, nil)
+		reservations = reserveCalls(resources[0], weights, delays, tenant, now)
+		return true
+	})
+	return delays, reservations, exists, tooHeavy, err
+}
+
+// validURL reports whether the URL is an absolute HTTP or HTTPS URL
+func validURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && u.Host != "" && (strings.EqualFold(u.Scheme, "http") || strings.EqualFold(u.Scheme, "https"))
+}
@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"meter_flow/dispatch"
+	"meter_flow/server"
+	"meter_flow/storage"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSubmitJobs(t *testing.T) {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+	dispatcher := dispatch.NewDispatcher(http.DefaultClient, JobSlots(server))
+
+	// An API limited to 10 requests per minute
+	registerTestResource(t, server)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pong"))
+	}))
+	defer api.Close()
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		requestBody    string
+		expectedStatus int
+		expectedJobs   int
+	}{
+		{
+			name:           "Valid jobs",
+			requestBody:    `{"resource_name":"test_resource", "requests":[{"method":"POST", "url":"` + api.URL + `", "body":"ping"}, {"url":"` + api.URL + `"}]}`,
+			expectedStatus: http.StatusAccepted,
+			expectedJobs:   2,
+		},
+		{
+			name:           "Resource not found",
+			requestBody:    `{"resource_name":"non_existent_resource", "requests":[{"url":"` + api.URL + `"}]}`,
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Invalid URL",
+			requestBody:    `{"resource_name":"test_resource", "requests":[{"url":"/relative"}]}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Too many attempts",
+			requestBody:    `{"resource_name":"test_resource", "requests":[{"url":"` + api.URL + `"}], "max_attempts":100}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "No requests",
+			requestBody:    `{"resource_name":"test_resource", "requests":[]}`,
+			expectedStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Create a new HTTP request
+			req, err := http.NewRequest("POST", "/jobs", bytes.NewBufferString(tc.requestBody))
+			if err != nil {
+				t.Errorf("failed to create request: %v", err)
+			}
+
+			// Create a new HTTP recorder
+			rr := httptest.NewRecorder()
+
+			// Call the submitJobs handler
+			handler := SubmitJobs(server, dispatcher)
+			handler(rr, req)
+
+			// Check the response status code
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tc.expectedStatus, rr.Code)
+			}
+			if tc.expectedJobs == 0 {
+				return
+			}
+
+			var response struct {
+				Jobs []struct {
+					ID string `json:"id"`
+				} `json:"jobs"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Errorf("failed to decode response body: %v", err)
+			}
+			if len(response.Jobs) != tc.expectedJobs {
+				t.Fatalf("expected %d jobs, got %d", tc.expectedJobs, len(response.Jobs))
+			}
+
+			// The jobs are sent right away, their results are kept for polling
+			for _, job := range response.Jobs {
+				polled := pollTestJob(t, dispatcher, job.ID)
+				if polled.Status != dispatch.StatusCompleted || polled.Result.Body != "pong" {
+					t.Errorf("expected job %s to be completed, got %+v", job.ID, polled)
+				}
+			}
+		})
+	}
+
+	// Each job took a slot of the resource
+	if calls := len(server.Resources["test_resource"].ScheduledCalls); calls != 2 {
+		t.Errorf("expected 2 calls scheduled, got %d", calls)
+	}
+}
+
+// pollTestJob polls the status endpoint until the job is finished
+func pollTestJob(t *testing.T, dispatcher *dispatch.Dispatcher, id string) dispatch.Job {
+	var job dispatch.Job
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		req, err := http.NewRequest("GET", "/jobs/"+id, nil)
+		if err != nil {
+			t.Errorf("failed to create request: %v", err)
+		}
+		req.SetPathValue("id", id)
+		rr := httptest.NewRecorder()
+		handler := JobStatus(dispatcher)
+		handler(rr, req)
+
+		if err := json.NewDecoder(rr.Body).Decode(&job); err != nil {
+			t.Errorf("failed to decode response body: %v", err)
+		}
+		if job.Status == dispatch.StatusCompleted || job.Status == dispatch.StatusFailed {
+			break
+		}
+	}
+	return job
+}
+
+func TestThrottledJob(t *testing.T) {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+	dispatcher := dispatch.NewDispatcher(http.DefaultClient, JobSlots(server))
+
+	// An API limited to 10 requests per minute, throttling the call and asking to wait a minute
+	registerTestResource(t, server)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "60")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer api.Close()
+
+	now := time.Now().UnixMilli()
+	req, err := http.NewRequest("POST", "/jobs", bytes.NewBufferString(`{"resource_name":"test_resource", "requests":[{"url":"`+api.URL+`"}], "max_attempts":1}`))
+	if err != nil {
+		t.Errorf("failed to create request: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	handler := SubmitJobs(server, dispatcher)
+	handler(rr, req)
+
+	var response struct {
+		Jobs []struct {
+			ID string `json:"id"`
+		} `json:"jobs"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil || len(response.Jobs) != 1 {
+		t.Fatalf("expected 1 job, got %v", err)
+	}
+	job := pollTestJob(t, dispatcher, response.Jobs[0].ID)
+	if job.Status != dispatch.StatusFailed || job.Result.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected the job to fail with %d, got %+v", http.StatusTooManyRequests, job)
+	}
+
+	// The resource is paused for the time asked, and the throttled call gave its slot back
+	resource := server.Resources["test_resource"]
+	if resource.PausedUntil < now+60000 {
+		t.Errorf("expected the resource to be paused for a minute, got %d", resource.PausedUntil-now)
+	}
+	if len(resource.ScheduledCalls) != 0 || len(resource.Reservations) != 0 {
+		t.Errorf("expected the slot to be released, got %d calls and %d reservations", len(resource.ScheduledCalls), len(resource.Reservations))
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+	dispatcher := dispatch.NewDispatcher(http.DefaultClient, JobSlots(server))
+
+	// A job waiting for the end of the pause of the resource
+	registerTestResource(t, server)
+	resource := server.Resources["test_resource"]
+	resource.PausedUntil = time.Now().UnixMilli() + 3600000
+	server.Resources["test_resource"] = resource
+
+	req, err := http.NewRequest("POST", "/jobs", bytes.NewBufferString(`{"resource_name":"test_resource", "requests":[{"url":"http://localhost"}]}`))
+	if err != nil {
+		t.Errorf("failed to create request: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	handler := SubmitJobs(server, dispatcher)
+	handler(rr, req)
+
+	var response struct {
+		Jobs []struct {
+			ID string `json:"id"`
+		} `json:"jobs"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil || len(response.Jobs) != 1 {
+		t.Fatalf("expected 1 job, got %v", err)
+	}
+	id := response.Jobs[0].ID
+
+	// Test cases, run in order on the same job
+	testCases := []struct {
+		name           string
+		id             string
+		expectedStatus int
+	}{
+		{
+			name:           "Job cancelled",
+			id:             id,
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "Job already cancelled",
+			id:             id,
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			name:           "Job not found",
+			id:             "job_unknown",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("DELETE", "/jobs/"+tc.id, nil)
+			if err != nil {
+				t.Errorf("failed to create request: %v", err)
+			}
+			req.SetPathValue("id", tc.id)
+			rr := httptest.NewRecorder()
+			handler := CancelJob(dispatcher)
+			handler(rr, req)
+
+			// Check the response status code
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tc.expectedStatus, rr.Code)
+			}
+		})
+	}
+
+	// The slot of the cancelled job was given back
+	resource = server.Resources["test_resource"]
+	if len(resource.ScheduledCalls) != 0 || len(resource.Reservations) != 0 {
+		t.Errorf("expected the slot to be released, got %d calls and %d reservations", len(resource.ScheduledCalls), len(resource.Reservations))
+	}
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"meter_flow/metrics"
+	"meter_flow/server"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ProxyRequest forwards a request to the upstream URL of a resource once the resource allows one more call, so that
+// tools that can't ask for a schedule share the budget of the resource with the clients that do. The request is
+// held until its slot, and the slot is given back if the client disconnects before. The response is streamed back.
+func ProxyRequest(srv *server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("resource")
+		resource, exists, err := srv.Resource(name)
+		if err != nil {
+			storageUnavailable(w, err)
+			return
+		}
+		if !exists {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+		upstream, err := url.Parse(resource.UpstreamURL)
+		if resource.UpstreamURL == "" || err != nil {
+			http.Error(w, "Resource has no upstream URL", http.StatusNotFound)
+			return
+		}
+
+		// The call takes a slot like any scheduled call
+		chain, err := resourceChain(srv, name)
+		if err != nil {
+			storageUnavailable(w, err)
+			return
+		}
+		now := time.Now().UnixMilli()
+		delay, exists, _, err := reserveSlot(srv, chain, defaultWeight, "", 0, now)
+		if err != nil {
+			storageUnavailable(w, err)
+			return
+		}
+		if !exists {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+		metrics.ObserveSchedule(name, []int{delay})
+
+		timer := time.NewTimer(time.Duration(delay) * time.Millisecond)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			// The client is gone, give the slot back
+			releaseSlot(srv, chain, now+int64(delay), defaultWeight)
+			return
+		}
+
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(pr *httputil.ProxyRequest) {
+				path, rawPath, subpath := upstreamPath(r.URL)
+				pr.Out.URL.Path, pr.Out.URL.RawPath = path, rawPath
+				pr.SetURL(upstream)
+				if !subpath {
+					// /proxy/{resource} alone is forwarded to the upstream URL as is, without a trailing slash
+					pr.Out.URL.Path, pr.Out.URL.RawPath = upstream.Path, upstream.RawPath
+				}
+				pr.SetXForwarded()
+			},
+			FlushInterval: -1, // Flush the response as it comes, for streamed responses
+		}
+		proxy.ServeHTTP(w, r)
+	}
+}
+
+// upstreamPath returns the path of a proxied request after /proxy/{resource}, decoded and as sent by the client, so
+// that escaped characters like %2F reach the upstream API unchanged. It returns false if there is no path after
+// the resource.
+func upstreamPath(u *url.URL) (string, string, bool) {
+	_, rest, subpath := strings.Cut(strings.TrimPrefix(u.EscapedPath(), "/proxy/"), "/")
+	rawPath := "/" + rest
+	path, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return rawPath, "", subpath
+	}
+	return path, rawPath, subpath
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"bufio"
+	"io"
+	"meter_flow/server"
+	"meter_flow/storage"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestProxy returns a MeterFlow server with the proxy endpoint, and an upstream API answering with the path and
+// query of the request, behind a resource limited to 1 request per 300 milliseconds
+func newTestProxy(t *testing.T, upstream http.HandlerFunc) *httptest.Server {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+
+	api := httptest.NewServer(upstream)
+	t.Cleanup(api.Close)
+	registerTestResourceBody(t, server, `{"name":"test_api", "request_count":1, "time_frame_ms":300, "upstream_url":"`+api.URL+`/v1"}`)
+	registerTestResource(t, server)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxy/{resource}", ProxyRequest(server))
+	mux.HandleFunc("/proxy/{resource}/{path...}", ProxyRequest(server))
+	proxy := httptest.NewServer(mux)
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestProxyRequest(t *testing.T) {
+	proxy := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	})
+
+	// Test cases, run in order on the same resources
+	testCases := []struct {
+		name           string
+		path           string
+		expectedStatus int
+		expectedOutput string
+		expectedWait   time.Duration
+	}{
+		{
+			name:           "Forwarded request",
+			path:           "/proxy/test_api/items?limit=2",
+			expectedStatus: http.StatusOK,
+			expectedOutput: "/v1/items?limit=2",
+		},
+		{
+			name:           "Request held until the next slot",
+			path:           "/proxy/test_api/items/1",
+			expectedStatus: http.StatusOK,
+			expectedOutput: "/v1/items/1",
+			expectedWait:   250 * time.Millisecond,
+		},
+		{
+			name:           "Escaped characters kept",
+			path:           "/proxy/test_api/files/a%2Fb%20c?name=x%26y",
+			expectedStatus: http.StatusOK,
+			expectedOutput: "/v1/files/a%2Fb%20c?name=x%26y",
+			expectedWait:   250 * time.Millisecond,
+		},
+		{
+			name:           "Upstream URL itself",
+			path:           "/proxy/test_api",
+			expectedStatus: http.StatusOK,
+			expectedOutput: "/v1",
+			expectedWait:   250 * time.Millisecond,
+		},
+		{
+			name:           "Resource without upstream URL",
+			path:           "/proxy/test_resource/items",
+			expectedStatus: http.StatusNotFound,
+			expectedOutput: "Resource has no upstream URL\n",
+		},
+		{
+			name:           "Resource not found",
+			path:           "/proxy/non_existent_resource/items",
+			expectedStatus: http.StatusNotFound,
+			expectedOutput: "Resource not found\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			start := time.Now()
+			resp, err := http.Get(proxy.URL + tc.path)
+			if err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			// Check the response status code
+			if resp.StatusCode != tc.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tc.expectedStatus, resp.StatusCode)
+			}
+
+			// Check the response body
+			if string(body) != tc.expectedOutput {
+				t.Errorf("expected response body %q, got %q", tc.expectedOutput, string(body))
+			}
+
+			// Check the request waited for its slot
+			if elapsed := time.Since(start); elapsed < tc.expectedWait {
+				t.Errorf("expected the request to wait at least %v, got %v", tc.expectedWait, elapsed)
+			}
+		})
+	}
+}
+
+func TestProxyRequestStreaming(t *testing.T) {
+	// The upstream API sends a first event, and the second one only once the first one was received
+	received := make(chan bool)
+	proxy := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Write([]byte("data: first\n"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+		}
+		w.Write([]byte("data: second\n"))
+	})
+
+	resp, err := http.Get(proxy.URL + "/proxy/test_api/stream")
+	if err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	for _, expected := range []string{"data: first\n", "data: second\n"} {
+		line, err := reader.ReadString('\n')
+		if err != nil || line != expected {
+			t.Fatalf("expected %q, got %q (%v)", expected, line, err)
+		}
+		if expected == "data: first\n" {
+			close(received)
+		}
+	}
+}
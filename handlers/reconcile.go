@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"meter_flow/model"
+	"meter_flow/server"
+	"os"
+	"reflect"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ResourceConfig is the declarative definition of the resources, kept in a YAML or JSON file
+type ResourceConfig struct {
+	Resources []resourceRequest `json:"resources"` // Same fields as the register endpoint
+	Prune     bool              `json:"prune"`     // Delete the registered resources missing from the file
+}
+
+// ReconcileResult lists the resources changed by a reconciliation
+type ReconcileResult struct {
+	Created   []string
+	Updated   []string
+	Deleted   []string
+	Unchanged int
+}
+
+// LoadResourceConfig reads and validates a resource config file. YAML is read with the field names of JSON, and
+// JSON being a subset of YAML, a JSON file is read the same way.
+func LoadResourceConfig(path string) (ResourceConfig, error) {
+	var config ResourceConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+
+	// Go through JSON for the field names and types of the register endpoint
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return config, err
+	}
+	encoded, err := json.Marshal(document)
+	if err != nil {
+		return config, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return config, err
+	}
+
+	names := make(map[string]bool, len(config.Resources))
+	for i := range config.Resources {
+		data := &config.Resources[i]
+		if data.Name == "" {
+			return config, fmt.Errorf("resource %d has no name", i+1)
+		}
+		if names[data.Name] {
+			return config, fmt.Errorf("resource %s is defined twice", data.Name)
+		}
+		if !data.valid() {
+			return config, fmt.Errorf("invalid settings for resource %s", data.Name)
+		}
+		names[data.Name] = true
+	}
+	return config, nil
+}
+
+// ReconcileResources creates and updates the resources to match the config, and deletes the ones missing from it if
+// the config prunes them. The updated resources keep their runtime state, like their scheduled calls and reservations.
+// The resulting resources are checked before anything is changed, so an invalid config leaves the resources untouched.
+func ReconcileResources(srv *server.Server, config ResourceConfig) (ReconcileResult, error) {
+	var result ReconcileResult
+
+	snapshot, err := srv.Snapshot()
+	if err != nil {
+		return result, err
+	}
+	names := make([]string, 0, len(snapshot)+len(config.Resources))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	for _, data := range config.Resources {
+		names = append(names, data.Name)
+	}
+	defer lockResources(srv, names)()
+
+	// The resources may have changed before they were locked
+	if snapshot, err = srv.Snapshot(); err != nil {
+		return result, err
+	}
+
+	// The resources once reconciled
+	target := make(map[string]model.Resource, len(config.Resources))
+	for _, data := range config.Resources {
+		target[data.Name] = data.resource()
+	}
+	var deleted []string
+	for name, resource := range snapshot {
+		if _, ok := target[name]; ok {
+			continue
+		}
+		if config.Prune {
+			deleted = append(deleted, name)
+		} else {
+			target[name] = resource
+		}
+	}
+	if err := checkParents(target); err != nil {
+		return result, err
+	}
+
+	// Create and update the parents before their children, delete the children before their parents
+	now := time.Now().UnixMilli()
+	configured := slices.Clone(config.Resources)
+	slices.SortStableFunc(configured, func(a, b resourceRequest) int {
+		return resourceDepth(target, a.Name) - resourceDepth(target, b.Name)
+	})
+	for _, data := range configured {
+		current, exists := snapshot[data.Name]
+		switch {
+		case !exists:
+			var added bool
+			if added, err = srv.AddResource(data.newResource(now)); err == nil && !added {
+				// Registered meanwhile by another server
+				_, err = srv.UpdateResource(data.Name, func(resource *model.Resource) bool {
+					data.applyTo(resource, now)
+					return true
+				})
+			}
+			result.Created = append(result.Created, data.Name)
+		case reflect.DeepEqual(resourceSettings(current), data.resource()):
+			result.Unchanged++
+		default:
+			_, err = srv.UpdateResource(data.Name, func(resource *model.Resource) bool {
+				data.applyTo(resource, now)
+				return true
+			})
+			result.Updated = append(result.Updated, data.Name)
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+
+	slices.SortFunc(deleted, func(a, b string) int {
+		return resourceDepth(snapshot, b) - resourceDepth(snapshot, a)
+	})
+	for _, name := range deleted {
+		if err := srv.RemoveResource(name); err != nil {
+			return result, err
+		}
+		result.Deleted = append(result.Deleted, name)
+	}
+	return result, nil
+}
+
+// checkParents checks that the parent of each resource exists and uses the sliding window, without cycles
+func checkParents(resources map[string]model.Resource) error {
+	for name, resource := range resources {
+		if resource.Parent == "" {
+			continue
+		}
+		parent, exists := resources[resource.Parent]
+		if !exists || parent.Algorithm == model.AlgorithmTokenBucket {
+			return fmt.Errorf("invalid parent %s for resource %s", resource.Parent, name)
+		}
+		if resourceDepth(resources, name) >= len(resources) {
+			return fmt.Errorf("resource %s is its own ancestor", name)
+		}
+	}
+	return nil
+}
+
+// resourceDepth returns the number of ancestors of a resource, at most the number of resources
+func resourceDepth(resources map[string]model.Resource, name string) int {
+	depth := 0
+	for parent := resources[name].Parent; parent != "" && depth < len(resources); parent = resources[parent].Parent {
+		depth++
+	}
+	return depth
+}
+
+// resourceSettings returns the resource without its runtime state, to compare it with a definition
+func resourceSettings(resource model.Resource) model.Resource {
+	resource.AdaptiveRequestCount = 0
+	resource.ScheduledCalls = nil
+	resource.ScheduledTokens = nil
+	resource.Reservations = nil
+	resource.PausedUntil = 0
+	resource.BucketTokens = 0
+	resource.BucketUpdated = 0
+	return resource
+}
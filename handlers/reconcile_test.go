@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"meter_flow/server"
+	"meter_flow/storage"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestLoadResourceConfig(t *testing.T) {
+	// Test cases
+	testCases := []struct {
+		name              string
+		file              string
+		content           string
+		expectedError     bool
+		expectedResources int
+	}{
+		{
+			name: "YAML config",
+			file: "resources.yaml",
+			content: `prune: true
+resources:
+  - name: openai
+    request_count: 500
+    time_frame: 60
+    limits:
+      - request_count: 10000
+        time_frame: 86400
+  - name: openai_key
+    parent: openai
+    request_count: 100
+    time_frame: 60
+  - name: github
+    algorithm: token_bucket
+    bucket_capacity: 100
+    refill_rate: 1.5
+`,
+			expectedResources: 3,
+		},
+		{
+			name:              "JSON config",
+			file:              "resources.json",
+			content:           `{"resources": [{"name": "openai", "request_count": 500, "time_frame": 60}]}`,
+			expectedResources: 1,
+		},
+		{
+			name:          "Unknown field",
+			file:          "resources.yaml",
+			content:       "resources:\n  - name: openai\n    requests: 500\n    time_frame: 60\n",
+			expectedError: true,
+		},
+		{
+			name:          "Duplicate resource",
+			file:          "resources.json",
+			content:       `{"resources": [{"name": "openai", "request_count": 500, "time_frame": 60}, {"name": "openai", "request_count": 5, "time_frame": 1}]}`,
+			expectedError: true,
+		},
+		{
+			name:          "Invalid settings",
+			file:          "resources.json",
+			content:       `{"resources": [{"name": "openai", "request_count": 500}]}`,
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tc.file)
+			if err := os.WriteFile(path, []byte(tc.content), 0644); err != nil {
+				t.Fatalf("failed to write config: %v", err)
+			}
+
+			config, err := LoadResourceConfig(path)
+
+			// Check the error
+			if (err != nil) != tc.expectedError {
+				t.Fatalf("expected error %v, got %v", tc.expectedError, err)
+			}
+
+			// Check the resources
+			if len(config.Resources) != tc.expectedResources && !tc.expectedError {
+				t.Errorf("expected %d resources, got %d", tc.expectedResources, len(config.Resources))
+			}
+		})
+	}
+}
+
+func TestReconcileResources(t *testing.T) {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+
+	// A resource registered through the API, with scheduled calls
+	registerTestResource(t, server)
+	resource := server.Resources["test_resource"]
+	resource.ScheduledCalls = []int64{time.Now().UnixMilli(), time.Now().UnixMilli(), time.Now().UnixMilli()}
+	resource.ScheduledTokens = []int{0, 0, 0}
+	server.Resources["test_resource"] = resource
+
+	// Test cases, run in order on the same resources
+	testCases := []struct {
+		name              string
+		config            ResourceConfig
+		expectedError     bool
+		expectedCreated   []string
+		expectedUpdated   []string
+		expectedDeleted   []string
+		expectedResources []string
+	}{
+		{
+			name: "Resources created and updated",
+			config: ResourceConfig{Resources: []resourceRequest{
+				{Name: "test_child", Parent: "test_parent", RequestCount: 5, TimeFrame: 60},
+				{Name: "test_parent", RequestCount: 100, TimeFrame: 60},
+				{Name: "test_resource", RequestCount: 20, TimeFrame: 60},
+			}},
+			expectedCreated:   []string{"test_parent", "test_child"},
+			expectedUpdated:   []string{"test_resource"},
+			expectedResources: []string{"test_child", "test_parent", "test_resource"},
+		},
+		{
+			name: "Resources unchanged",
+			config: ResourceConfig{Resources: []resourceRequest{
+				{Name: "test_parent", RequestCount: 100, TimeFrame: 60},
+				{Name: "test_resource", RequestCount: 20, TimeFrame: 60},
+			}},
+			expectedResources: []string{"test_child", "test_parent", "test_resource"},
+		},
+		{
+			name: "Parent missing from the pruned resources",
+			config: ResourceConfig{Prune: true, Resources: []resourceRequest{
+				{Name: "test_child", Parent: "test_parent", RequestCount: 5, TimeFrame: 60},
+				{Name: "test_resource", RequestCount: 20, TimeFrame: 60},
+			}},
+			expectedError:     true,
+			expectedResources: []string{"test_child", "test_parent", "test_resource"},
+		},
+		{
+			name: "Token bucket parent",
+			config: ResourceConfig{Resources: []resourceRequest{
+				{Name: "test_parent", Algorithm: "token_bucket", BucketCapacity: 10, RefillRate: 1},
+			}},
+			expectedError:     true,
+			expectedResources: []string{"test_child", "test_parent", "test_resource"},
+		},
+		{
+			name: "Resources pruned",
+			config: ResourceConfig{Prune: true, Resources: []resourceRequest{
+				{Name: "test_resource", RequestCount: 20, TimeFrame: 60},
+			}},
+			expectedDeleted:   []string{"test_child", "test_parent"},
+			expectedResources: []string{"test_resource"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for i := range tc.config.Resources {
+				tc.config.Resources[i].valid()
+			}
+			result, err := ReconcileResources(server, tc.config)
+
+			// Check the error
+			if (err != nil) != tc.expectedError {
+				t.Fatalf("expected error %v, got %v", tc.expectedError, err)
+			}
+
+			// Check the changes
+			if !slices.Equal(result.Created, tc.expectedCreated) {
+				t.Errorf("expected created %v, got %v", tc.expectedCreated, result.Created)
+			}
+			if !slices.Equal(result.Updated, tc.expectedUpdated) {
+				t.Errorf("expected updated %v, got %v", tc.expectedUpdated, result.Updated)
+			}
+			if !slices.Equal(result.Deleted, tc.expectedDeleted) {
+				t.Errorf("expected deleted %v, got %v", tc.expectedDeleted, result.Deleted)
+			}
+
+			// Check the resources
+			var names []string
+			for name := range server.Resources {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+			if !slices.Equal(names, tc.expectedResources) {
+				t.Errorf("expected resources %v, got %v", tc.expectedResources, names)
+			}
+		})
+	}
+
+	// The updated resource kept its scheduled calls
+	resource = server.Resources["test_resource"]
+	if resource.RequestCount != 20 || len(resource.ScheduledCalls) != 3 {
+		t.Errorf("expected 20 requests and 3 scheduled calls, got %d and %d", resource.RequestCount, len(resource.ScheduledCalls))
+	}
+}
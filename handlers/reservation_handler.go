@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"meter_flow/model"
+	"meter_flow/server"
+	"net/http"
+	"strings"
+)
+
+// ReleaseReservation gives back the slot of a single reservation, when the call it was made for won't happen
+func ReleaseReservation(srv *server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.PathValue("id")
+
+		released, err := releaseReservation(srv, id)
+		if err != nil {
+			storageUnavailable(w, err)
+			return
+		}
+		if !released {
+			http.Error(w, "Reservation not found", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		message := fmt.Sprintf("Reservation %s released\n", id)
+		w.Write([]byte(message))
+	}
+}
+
+// ReleaseReservations gives back the slots of several reservations at once, for instance when a batch is cancelled
+func ReleaseReservations(srv *server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var data struct {
+			IDs []string `json:"ids"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || len(data.IDs) == 0 {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		released := 0
+		for _, id := range data.IDs {
+			ok, err := releaseReservation(srv, id)
+			if err != nil {
+				storageUnavailable(w, err)
+				return
+			}
+			if ok {
+				released++
+			}
+		}
+
+		response := map[string]interface{}{
+			"released": released,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// releaseReservation removes the reservation and its scheduled call from its resource, it returns false if it doesn't exist
+func releaseReservation(srv *server.Server, id string) (bool, error) {
+	name, ok := reservationResource(id)
+	if !ok {
+		return false, nil
+	}
+
+	// Get the mutexes of the resource and its ancestors, the call is released from all of them
+	chain, err := resourceChain(srv, name)
+	if err != nil {
+		return false, err
+	}
+	defer lockResources(srv, chain)()
+
+	released := false
+	_, err = srv.UpdateResources(chain, func(resources []*model.Resource) bool {
+		resource := resources[0]
+		reservation, exists := resource.Reservations[id]
+		if released = exists; !exists {
+			return false
+		}
+
+		releaseCall(resources, reservation.Timestamp, reservation.Weight)
+		ownReservations(resource, 0)
+		delete(resource.Reservations, id)
+		return true
+	})
+	return released, err
+}
+
+// reserveCalls records a reservation for each call of the tenant scheduled at now plus its delay, and returns their IDs.
+// Reservations that can't free anything anymore are pruned first.
+func reserveCalls(resource *model.Resource, weights, delays []int, tenant string, now int64) []string {
+	ownReservations(resource, len(delays))
+	pruneReservations(resource, now)
+
+	ids := make([]string, len(delays))
+	for i, delay := range delays {
+		ids[i] = newReservationID(resource.Name)
+		resource.Reservations[ids[i]] = model.Reservation{Timestamp: now + int64(delay), Weight: weights[i], Tenant: tenant}
+	}
+	return ids
+}
+
+// ownReservations replaces the reservations of the resource with a copy, with room for the given number of new ones,
+// so that they can be modified: the map may be shared with a snapshot being saved.
+func ownReservations(resource *model.Resource, room int) {
+	reservations := make(map[string]model.Reservation, len(resource.Reservations)+room)
+	maps.Copy(reservations, resource.Reservations)
+	resource.Reservations = reservations
+}
+
+// pruneReservations removes the reservations of calls that already left every window of the resource.
+// The reservations map is modified in place, it must not be shared.
+func pruneReservations(resource *model.Resource, now int64) {
+	start := now - resource.LongestTimeFrameMillis()
+	for id, reservation := range resource.Reservations {
+		if reservation.Timestamp <= start {
+			delete(resource.Reservations, id)
+		}
+	}
+}
+
+// newReservationID returns a random ID followed by the encoded name of the resource,
+// so that any server can find the resource of a reservation
+func newReservationID(resourceName string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b) + "." + base64.RawURLEncoding.EncodeToString([]byte(resourceName))
+}
+
+// reservationResource returns the name of the resource of a reservation ID
+func reservationResource(id string) (string, bool) {
+	_, encoded, found := strings.Cut(id, ".")
+	if !found {
+		return "", false
+	}
+	name, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+	return string(name), true
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"meter_flow/server"
+	"meter_flow/storage"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReleaseReservation(t *testing.T) {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+
+	// An API limited to 2 requests per minute, its slots are reserved by a first batch
+	registerTestResourceBody(t, server, `{"name":"test_resource", "request_count":2, "time_frame":60}`)
+	delays, reservations := scheduleTestCalls(t, server, `{"resource_name":"test_resource", "num_calls":2}`)
+	if delays[1] != 0 {
+		t.Errorf("expected the first batch to be scheduled immediately, got %v", delays)
+	}
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		id             string
+		expectedStatus int
+		expectedOutput string
+	}{
+		{
+			name:           "Valid release",
+			id:             reservations[1],
+			expectedStatus: http.StatusOK,
+			expectedOutput: "Reservation " + reservations[1] + " released\n",
+		},
+		{
+			name:           "Reservation already released",
+			id:             reservations[1],
+			expectedStatus: http.StatusNotFound,
+			expectedOutput: "Reservation not found\n",
+		},
+		{
+			name:           "Reservation not found",
+			id:             "non_existent_reservation",
+			expectedStatus: http.StatusNotFound,
+			expectedOutput: "Reservation not found\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Create a new HTTP request
+			req, err := http.NewRequest("DELETE", "/reservations/"+tc.id, nil)
+			if err != nil {
+				t.Errorf("failed to create request: %v", err)
+			}
+			req.SetPathValue("id", tc.id)
+
+			// Create a new HTTP recorder
+			rr := httptest.NewRecorder()
+
+			// Call the releaseReservation handler
+			handler := ReleaseReservation(server)
+			handler(rr, req)
+
+			// Check the response status code
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tc.expectedStatus, rr.Code)
+			}
+
+			// Check the response body
+			if rr.Body.String() != tc.expectedOutput {
+				t.Errorf("expected response body %q, got %q", tc.expectedOutput, rr.Body.String())
+			}
+		})
+	}
+
+	// The released slot is reused by the next schedule request
+	delays, _ = scheduleTestCalls(t, server, `{"resource_name":"test_resource", "num_calls":1}`)
+	if delays[0] != 0 {
+		t.Errorf("expected the released slot to be reused, got a delay of %d ms", delays[0])
+	}
+}
+
+func TestReleaseReservations(t *testing.T) {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+
+	// An API limited to 10 requests per minute, with a batch of 30 calls spanning 3 minutes
+	registerTestResourceBody(t, server, `{"name":"test_resource", "request_count":10, "time_frame":60}`)
+	_, reservations := scheduleTestCalls(t, server, `{"resource_name":"test_resource", "num_calls":30}`)
+
+	// The batch is cancelled after its first 10 calls
+	requestBody, err := json.Marshal(map[string]interface{}{"ids": append(reservations[10:], "non_existent_reservation")})
+	if err != nil {
+		t.Errorf("failed to marshal request body: %v", err)
+	}
+
+	req, err := http.NewRequest("DELETE", "/reservations", bytes.NewBuffer(requestBody))
+	if err != nil {
+		t.Errorf("failed to create request: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := ReleaseReservations(server)
+	handler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	expectedOutput := "{\"released\":20}\n"
+	if rr.Body.String() != expectedOutput {
+		t.Errorf("expected response body %q, got %q", expectedOutput, rr.Body.String())
+	}
+
+	// Only the calls that were made are left
+	if calls := server.Resources["test_resource"].ScheduledCalls; len(calls) != 10 {
+		t.Errorf("expected 10 scheduled calls, got %d", len(calls))
+	}
+}
+
+// scheduleTestCalls schedules calls and returns their delays in milliseconds and their reservation IDs
+func scheduleTestCalls(t *testing.T, server *server.Server, requestBody string) ([]int, []string) {
+	req, err := http.NewRequest("POST", "/schedule", bytes.NewBufferString(requestBody))
+	if err != nil {
+		t.Errorf("failed to create request: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := ScheduleCalls(server)
+	handler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	var response struct {
+		DelaysMs     []int    `json:"delays_ms"`
+		Reservations []string `json:"reservations"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Errorf("failed to decode response body: %v", err)
+	}
+	return response.DelaysMs, response.Reservations
+}
@@ -3,22 +3,190 @@ package handlers
 import (
 	"encoding/json"
 	"fmt"
+	"log"
+	"math"
 	"meter_flow/model"
 	"meter_flow/server"
 	"net/http"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 )
 
+// Request body shared by the register and update endpoints
+type resourceRequest struct {
+	Name           string        `json:"name"`
+	Algorithm      string        `json:"algorithm"`
+	RequestCount   int           `json:"request_count"`
+	TimeFrame      int           `json:"time_frame"`
+	TimeFrameMs    int           `json:"time_frame_ms"` // Alternative to time_frame for sub-second time frames
+	TokenCount     int           `json:"token_count"`
+	Limits         []model.Limit `json:"limits"`       // Additional limits, for instance per minute and per day
+	Parent         string        `json:"parent"`       // Resource whose limits also apply, for instance the organization of an API key
+	Adaptive       bool          `json:"adaptive"`     // The request count is only a ceiling, the limit adapts to the feedback of the API
+	UpstreamURL    string        `json:"upstream_url"` // Base URL of the API, to call it through the proxy
+	BucketCapacity int           `json:"bucket_capacity"`
+	RefillRate     float64       `json:"refill_rate"`
+
+	HighPriorityShare float64            `json:"high_priority_share"` // Share of the limits kept for high priority calls, for instance 0.2
+	TenantCap         float64            `json:"tenant_cap"`          // Largest share of the limits a single tenant can use
+	TenantWeights     map[string]float64 `json:"tenant_weights"`      // Weight of each tenant in the fair share, 1 if missing
+}
+
+// valid normalizes the algorithm and checks the settings it requires
+func (data *resourceRequest) valid() bool {
+	if data.Algorithm == "" {
+		data.Algorithm = model.AlgorithmSlidingWindow
+	}
+	if data.UpstreamURL != "" && !validURL(data.UpstreamURL) {
+		return false
+	}
+
+	switch data.Algorithm {
+	case model.AlgorithmSlidingWindow:
+		if data.HighPriorityShare < 0 || data.HighPriorityShare >= 1 || data.TenantCap < 0 || data.TenantCap > 1 {
+			return false
+		}
+		for _, weight := range data.TenantWeights {
+			if weight <= 0 {
+				return false
+			}
+		}
+		for _, limit := range data.resource().SlidingWindowLimits() {
+			if limit.RequestCount <= 0 || limit.TimeFrameMillis() <= 0 || limit.TimeFrame < 0 || limit.TimeFrameMs < 0 || limit.TokenCount < 0 {
+				return false
+			}
+		}
+		return true
+	case model.AlgorithmTokenBucket:
+		// Token and stacked limits, priorities, tenant shares, parents and adaptive limits are only supported by the sliding window
+		return data.BucketCapacity > 0 && data.RefillRate > 0 && data.TokenCount == 0 && len(data.Limits) == 0 &&
+			data.HighPriorityShare == 0 && data.TenantCap == 0 && len(data.TenantWeights) == 0 && data.Parent == "" && !data.Adaptive
+	default:
+		return false
+	}
+}
+
+// limitDescription describes the limit of the resource for the response messages
+func (data *resourceRequest) limitDescription() string {
+	if data.Algorithm == model.AlgorithmTokenBucket {
+		return fmt.Sprintf("bucket of %d tokens refilled at %g tokens per second", data.BucketCapacity, data.RefillRate)
+	}
+
+	var descriptions []string
+	for _, limit := range data.resource().SlidingWindowLimits() {
+		timeFrame := fmt.Sprintf("%d seconds", limit.TimeFrame)
+		if limit.TimeFrameMs > 0 {
+			timeFrame = fmt.Sprintf("%d milliseconds", limit.TimeFrameMs)
+		}
+
+		if limit.TokenCount > 0 {
+			descriptions = append(descriptions, fmt.Sprintf("%d requests and %d tokens per %s", limit.RequestCount, limit.TokenCount, timeFrame))
+		} else {
+			descriptions = append(descriptions, fmt.Sprintf("%d requests per %s", limit.RequestCount, timeFrame))
+		}
+	}
+
+	if data.Adaptive {
+		descriptions[0] = "up to " + descriptions[0]
+	}
+	description := "limit of " + descriptions[0]
+	if last := len(descriptions) - 1; last > 0 {
+		description = "limits of " + strings.Join(descriptions[:last], ", ") + " and " + descriptions[last]
+	}
+	if data.HighPriorityShare > 0 {
+		description += fmt.Sprintf(", keeping %g%% for high priority calls", data.HighPriorityShare*100)
+	}
+	if data.TenantCap > 0 {
+		description += fmt.Sprintf(", at most %g%% per tenant", data.TenantCap*100)
+	}
+	if data.Parent != "" {
+		description += " under " + data.Parent
+	}
+	return description
+}
+
+// validParent checks that the parent of the resource exists and uses the sliding window, and that the resource
+// isn't one of its ancestors
+func (data *resourceRequest) validParent(srv *server.Server) (bool, error) {
+	if data.Parent == "" {
+		return true, nil
+	}
+
+	chain, err := resourceChain(srv, data.Parent)
+	if err != nil {
+		return false, err
+	}
+	if slices.Contains(chain, data.Name) {
+		return false, nil
+	}
+	parent, exists, err := srv.Resource(data.Parent)
+	if err != nil {
+		return false, err
+	}
+	return exists && parent.Algorithm != model.AlgorithmTokenBucket, nil
+}
+
+// resource returns the settings of the request as a resource, without any state
+func (data *resourceRequest) resource() model.Resource {
+	return model.Resource{
+		Name:           data.Name,
+		Algorithm:      data.Algorithm,
+		RequestCount:   data.RequestCount,
+		TimeFrame:      data.TimeFrame,
+		TimeFrameMs:    data.TimeFrameMs,
+		TokenCount:     data.TokenCount,
+		Limits:         data.Limits,
+		Parent:         data.Parent,
+		Adaptive:       data.Adaptive,
+		UpstreamURL:    data.UpstreamURL,
+		BucketCapacity: data.BucketCapacity,
+		RefillRate:     data.RefillRate,
+
+		HighPriorityShare: data.HighPriorityShare,
+		TenantCap:         data.TenantCap,
+		TenantWeights:     data.TenantWeights,
+	}
+}
+
+// newResource returns the settings of the request as a new resource, whose bucket starts full
+func (data *resourceRequest) newResource(now int64) model.Resource {
+	resource := data.resource()
+	resource.BucketTokens = float64(data.BucketCapacity)
+	resource.BucketUpdated = now
+	return resource
+}
+
+// applyTo replaces the settings of the resource with the ones of the request, keeping its runtime state
+func (data *resourceRequest) applyTo(resource *model.Resource, now int64) {
+	// Keep the bucket state, unless the resource is switching to the token bucket algorithm
+	if resource.Algorithm != model.AlgorithmTokenBucket {
+		resource.BucketTokens = float64(data.BucketCapacity)
+		resource.BucketUpdated = now
+	}
+	resource.BucketTokens = math.Min(resource.BucketTokens, float64(data.BucketCapacity))
+
+	updated := data.resource()
+	updated.ScheduledCalls = resource.ScheduledCalls
+	updated.ScheduledTokens = resource.ScheduledTokens
+	updated.BucketTokens = resource.BucketTokens
+	updated.BucketUpdated = resource.BucketUpdated
+	updated.Reservations = resource.Reservations
+	updated.PausedUntil = resource.PausedUntil
+	if updated.Adaptive && resource.Adaptive {
+		// Keep the learned request count, within the new ceiling
+		updated.AdaptiveRequestCount = min(resource.EffectiveRequestCount(), updated.RequestCount)
+	}
+	*resource = updated
+}
+
 func RegisterResource(srv *server.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		var data struct {
-			Name         string `json:"name"`
-			RequestCount int    `json:"request_count"`
-			TimeFrame    int    `json:"time_frame"`
-		}
+		var data resourceRequest
 
-		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.RequestCount <= 0 || data.TimeFrame <= 0 {
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || !data.valid() {
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
 		}
@@ -30,38 +198,89 @@ func RegisterResource(srv *server.Server) http.HandlerFunc {
 		defer mu.Unlock()
 
 		// Register the new resource
-		if _, exists := srv.Resources[data.Name]; exists {
+		_, exists, err := srv.Resource(data.Name)
+		if err != nil {
+			storageUnavailable(w, err)
+			return
+		}
+		if exists {
 			http.Error(w, "Resource already exists", http.StatusConflict)
 			return
 		}
+		if valid, err := data.validParent(srv); err != nil || !valid {
+			invalidParent(w, err)
+			return
+		}
 
-		srv.Resources[data.Name] = model.Resource{
-			Name:         data.Name,
-			RequestCount: data.RequestCount,
-			TimeFrame:    data.TimeFrame,
+		// Another server may have registered it meanwhile
+		added, err := srv.AddResource(data.newResource(time.Now().UnixMilli()))
+		if err != nil {
+			storageUnavailable(w, err)
+			return
+		}
+		if !added {
+			http.Error(w, "Resource already exists", http.StatusConflict)
+			return
 		}
 
 		w.WriteHeader(http.StatusCreated)
-		message := fmt.Sprintf("Resource %s with limit of %d requests per %d seconds registered\n", data.Name, data.RequestCount, data.TimeFrame)
+		message := fmt.Sprintf("Resource %s with %s registered\n", data.Name, data.limitDescription())
 		w.Write([]byte(message))
 	}
 }
 
 type ResourceResponse struct {
-	Name         string `json:"name"`
-	RequestCount int    `json:"request_count"`
-	TimeFrame    int    `json:"time_frame"`
+	Name           string        `json:"name"`
+	Algorithm      string        `json:"algorithm,omitempty"`
+	RequestCount   int           `json:"request_count"`
+	TimeFrame      int           `json:"time_frame"`
+	TimeFrameMs    int           `json:"time_frame_ms,omitempty"`
+	TokenCount     int           `json:"token_count,omitempty"`
+	Limits         []model.Limit `json:"limits,omitempty"`
+	Parent         string        `json:"parent,omitempty"`
+	Adaptive       bool          `json:"adaptive,omitempty"`
+	UpstreamURL    string        `json:"upstream_url,omitempty"`
+	BucketCapacity int           `json:"bucket_capacity,omitempty"`
+	RefillRate     float64       `json:"refill_rate,omitempty"`
+
+	HighPriorityShare float64            `json:"high_priority_share,omitempty"`
+	TenantCap         float64            `json:"tenant_cap,omitempty"`
+	TenantWeights     map[string]float64 `json:"tenant_weights,omitempty"`
+
+	EffectiveRequestCount int `json:"effective_request_count,omitempty"` // Current request count of an adaptive resource
 }
 
 func ListResources(srv *server.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		resources := make([]ResourceResponse, 0, len(srv.Resources))
-		for _, resource := range srv.Resources {
-			resources = append(resources, ResourceResponse{
-				Name:         resource.Name,
-				RequestCount: resource.RequestCount,
-				TimeFrame:    resource.TimeFrame,
-			})
+		snapshot, err := srv.Snapshot()
+		if err != nil {
+			storageUnavailable(w, err)
+			return
+		}
+		resources := make([]ResourceResponse, 0, len(snapshot))
+		for _, resource := range snapshot {
+			response := ResourceResponse{
+				Name:           resource.Name,
+				Algorithm:      resource.Algorithm,
+				RequestCount:   resource.RequestCount,
+				TimeFrame:      resource.TimeFrame,
+				TimeFrameMs:    resource.TimeFrameMs,
+				TokenCount:     resource.TokenCount,
+				Limits:         resource.Limits,
+				Parent:         resource.Parent,
+				Adaptive:       resource.Adaptive,
+				UpstreamURL:    resource.UpstreamURL,
+				BucketCapacity: resource.BucketCapacity,
+				RefillRate:     resource.RefillRate,
+
+				HighPriorityShare: resource.HighPriorityShare,
+				TenantCap:         resource.TenantCap,
+				TenantWeights:     resource.TenantWeights,
+			}
+			if resource.Adaptive {
+				response.EffectiveRequestCount = resource.EffectiveRequestCount()
+			}
+			resources = append(resources, response)
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -71,12 +290,8 @@ func ListResources(srv *server.Server) http.HandlerFunc {
 
 func UpdateResource(srv *server.Server) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var data struct {
-			Name         string `json:"name"`
-			RequestCount int    `json:"request_count"`
-			TimeFrame    int    `json:"time_frame"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.RequestCount <= 0 || data.TimeFrame <= 0 {
+		var data resourceRequest
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || !data.valid() {
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
 		}
@@ -87,21 +302,41 @@ func UpdateResource(srv *server.Server) http.HandlerFunc {
 		mu.Lock()
 		defer mu.Unlock()
 
-		// Update the resource
-		if _, exists := srv.Resources[data.Name]; !exists {
-			http.Error(w, "Resource not found", http.StatusNotFound)
+		if valid, err := data.validParent(srv); err != nil || !valid {
+			invalidParent(w, err)
 			return
 		}
 
-		srv.Resources[data.Name] = model.Resource{
-			Name:           data.Name,
-			RequestCount:   data.RequestCount,
-			TimeFrame:      data.TimeFrame,
-			ScheduledCalls: srv.Resources[data.Name].ScheduledCalls,
+		// The children of a resource need its sliding window limits
+		if data.Algorithm == model.AlgorithmTokenBucket {
+			children, err := hasChildren(srv, data.Name)
+			if err != nil {
+				storageUnavailable(w, err)
+				return
+			}
+			if children {
+				http.Error(w, "Resource has child resources", http.StatusConflict)
+				return
+			}
+		}
+
+		// Update the resource, keeping its runtime state
+		now := time.Now().UnixMilli()
+		exists, err := srv.UpdateResource(data.Name, func(resource *model.Resource) bool {
+			data.applyTo(resource, now)
+			return true
+		})
+		if err != nil {
+			storageUnavailable(w, err)
+			return
+		}
+		if !exists {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
 		}
 
 		w.WriteHeader(http.StatusOK)
-		message := fmt.Sprintf("Resource %s updated with limit of %d requests per %d seconds\n", data.Name, data.RequestCount, data.TimeFrame)
+		message := fmt.Sprintf("Resource %s updated with %s\n", data.Name, data.limitDescription())
 		w.Write([]byte(message))
 	}
 }
@@ -123,15 +358,63 @@ func DeleteResource(srv *server.Server) http.HandlerFunc {
 		defer mu.Unlock()
 
 		// Delete the resource
-		if _, exists := srv.Resources[data.Name]; !exists {
+		_, exists, err := srv.Resource(data.Name)
+		if err != nil {
+			storageUnavailable(w, err)
+			return
+		}
+		if !exists {
 			http.Error(w, "Resource not found", http.StatusNotFound)
 			return
 		}
 
-		delete(srv.Resources, data.Name)
+		// The limits of a parent apply to its children, it can't be deleted before them
+		children, err := hasChildren(srv, data.Name)
+		if err != nil {
+			storageUnavailable(w, err)
+			return
+		}
+		if children {
+			http.Error(w, "Resource has child resources", http.StatusConflict)
+			return
+		}
+
+		if err := srv.RemoveResource(data.Name); err != nil {
+			storageUnavailable(w, err)
+			return
+		}
 
 		w.WriteHeader(http.StatusOK)
 		message := fmt.Sprintf("Resource %s deleted\n", data.Name)
 		w.Write([]byte(message))
 	}
 }
+
+// hasChildren reports whether some resources have the given resource as parent
+func hasChildren(srv *server.Server, name string) (bool, error) {
+	snapshot, err := srv.Snapshot()
+	if err != nil {
+		return false, err
+	}
+	for _, resource := range snapshot {
+		if resource.Parent == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// invalidParent answers a request with a parent that doesn't exist, doesn't use the sliding window or is a child of the resource
+func invalidParent(w http.ResponseWriter, err error) {
+	if err != nil {
+		storageUnavailable(w, err)
+		return
+	}
+	http.Error(w, "Invalid parent", http.StatusBadRequest)
+}
+
+// storageUnavailable answers a request that failed because the storage shared with other servers couldn't be reached
+func storageUnavailable(w http.ResponseWriter, err error) {
+	log.Printf("Storage error: %v", err)
+	http.Error(w, "Storage unavailable", http.StatusServiceUnavailable)
+}
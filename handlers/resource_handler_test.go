@@ -41,6 +41,96 @@ func TestRegisterResource(t *testing.T) {
 			expectedStatus: http.StatusBadRequest,
 			expectedOutput: "Invalid request\n",
 		},
+		{
+			name:           "Valid token limit registration",
+			requestBody:    `{"name":"test_llm", "request_count":10, "token_count":1000, "time_frame":60}`,
+			expectedStatus: http.StatusCreated,
+			expectedOutput: "Resource test_llm with limit of 10 requests and 1000 tokens per 60 seconds registered\n",
+		},
+		{
+			name:           "Valid millisecond registration",
+			requestBody:    `{"name":"test_ms", "request_count":1, "time_frame_ms":50}`,
+			expectedStatus: http.StatusCreated,
+			expectedOutput: "Resource test_ms with limit of 1 requests per 50 milliseconds registered\n",
+		},
+		{
+			name:           "Valid priority registration",
+			requestBody:    `{"name":"test_priority", "request_count":10, "time_frame":60, "high_priority_share":0.2}`,
+			expectedStatus: http.StatusCreated,
+			expectedOutput: "Resource test_priority with limit of 10 requests per 60 seconds, keeping 20% for high priority calls registered\n",
+		},
+		{
+			name:           "Invalid priority share",
+			requestBody:    `{"name":"test_priority_share", "request_count":10, "time_frame":60, "high_priority_share":1}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedOutput: "Invalid request\n",
+		},
+		{
+			name:           "Valid tenant cap registration",
+			requestBody:    `{"name":"test_tenants", "request_count":10, "time_frame":60, "tenant_cap":0.5}`,
+			expectedStatus: http.StatusCreated,
+			expectedOutput: "Resource test_tenants with limit of 10 requests per 60 seconds, at most 50% per tenant registered\n",
+		},
+		{
+			name:           "Valid child registration",
+			requestBody:    `{"name":"test_child", "request_count":5, "time_frame":60, "parent":"test_resource"}`,
+			expectedStatus: http.StatusCreated,
+			expectedOutput: "Resource test_child with limit of 5 requests per 60 seconds under test_resource registered\n",
+		},
+		{
+			name:           "Unknown parent",
+			requestBody:    `{"name":"other_child", "request_count":5, "time_frame":60, "parent":"non_existent_resource"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedOutput: "Invalid parent\n",
+		},
+		{
+			name:           "Valid adaptive registration",
+			requestBody:    `{"name":"test_adaptive", "request_count":100, "time_frame":60, "adaptive":true}`,
+			expectedStatus: http.StatusCreated,
+			expectedOutput: "Resource test_adaptive with limit of up to 100 requests per 60 seconds registered\n",
+		},
+		{
+			name:           "Valid stacked limits registration",
+			requestBody:    `{"name":"test_stacked", "request_count":10, "time_frame":1, "limits":[{"request_count":500, "time_frame":60}, {"request_count":10000, "time_frame":86400}]}`,
+			expectedStatus: http.StatusCreated,
+			expectedOutput: "Resource test_stacked with limits of 10 requests per 1 seconds, 500 requests per 60 seconds and 10000 requests per 86400 seconds registered\n",
+		},
+		{
+			name:           "Invalid stacked limit",
+			requestBody:    `{"name":"other_stacked", "request_count":10, "time_frame":1, "limits":[{"request_count":500}]}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedOutput: "Invalid request\n",
+		},
+		{
+			name:           "Valid token bucket registration",
+			requestBody:    `{"name":"test_bucket", "algorithm":"token_bucket", "bucket_capacity":20, "refill_rate":0.5}`,
+			expectedStatus: http.StatusCreated,
+			expectedOutput: "Resource test_bucket with bucket of 20 tokens refilled at 0.5 tokens per second registered\n",
+		},
+		{
+			name:           "Token bucket without refill rate",
+			requestBody:    `{"name":"other_bucket", "algorithm":"token_bucket", "bucket_capacity":20}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedOutput: "Invalid request\n",
+		},
+		{
+			name:           "Adaptive token bucket",
+			requestBody:    `{"name":"other_bucket", "algorithm":"token_bucket", "bucket_capacity":20, "refill_rate":0.5, "adaptive":true}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedOutput: "Invalid request\n",
+		},
+		{
+			name:           "Relative upstream URL",
+			requestBody:    `{"name":"other_resource", "request_count":10, "time_frame":60, "upstream_url":"/v1"}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedOutput: "Invalid request\n",
+		},
+		{
+			name:           "Unknown algorithm",
+			requestBody:    `{"name":"other_resource", "algorithm":"leaky_bucket", "request_count":10, "time_frame":60}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedOutput: "Invalid request\n",
+		},
 	}
 
 	for _, tc := range testCases {
@@ -118,17 +208,62 @@ func TestListResources(t *testing.T) {
 	}
 }
 
+func TestListAdaptiveResources(t *testing.T) {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+
+	// Register an adaptive resource whose request count went down
+	server.Resources = map[string]model.Resource{
+		"test_adaptive": {
+			Name:                 "test_adaptive",
+			RequestCount:         20,
+			TimeFrame:            120,
+			Adaptive:             true,
+			AdaptiveRequestCount: 5,
+		},
+	}
+
+	req, err := http.NewRequest("GET", "/resources", nil)
+	if err != nil {
+		t.Errorf("failed to create request: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	handler := ListResources(server)
+	handler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	var resources []ResourceResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resources); err != nil {
+		t.Errorf("failed to decode response body: %v", err)
+	}
+
+	// The adaptive resource shows its current request count along with the configured one
+	if len(resources) != 1 || resources[0].EffectiveRequestCount != 5 || resources[0].RequestCount != 20 {
+		t.Errorf("expected a request count of 20 with an effective one of 5, got %+v", resources)
+	}
+}
+
 func TestUpdateResource(t *testing.T) {
 	storage := storage.NewDummyStorage()
 	server := server.NewServer(storage)
 
-	// Register a test resource
+	// Register test resources
 	server.Resources = map[string]model.Resource{
 		"test_resource": {
 			Name:         "test_resource",
 			RequestCount: 10,
 			TimeFrame:    60,
 		},
+		"test_bucket": {
+			Name:           "test_bucket",
+			Algorithm:      model.AlgorithmTokenBucket,
+			BucketCapacity: 10,
+			RefillRate:     1,
+			BucketTokens:   -5,
+			BucketUpdated:  1729954499,
+		},
 	}
 
 	// Test cases
@@ -138,6 +273,12 @@ func TestUpdateResource(t *testing.T) {
 		expectedStatus int
 		expectedOutput string
 	}{
+		{
+			name:           "Valid token bucket update",
+			requestBody:    `{"name":"test_bucket", "algorithm":"token_bucket", "bucket_capacity":20, "refill_rate":2}`,
+			expectedStatus: http.StatusOK,
+			expectedOutput: "Resource test_bucket updated with bucket of 20 tokens refilled at 2 tokens per second\n",
+		},
 		{
 			name:           "Valid update",
 			requestBody:    `{"name":"test_resource", "request_count":20, "time_frame":120}`,
@@ -184,19 +325,36 @@ func TestUpdateResource(t *testing.T) {
 			}
 		})
 	}
+
+	// The bucket state survives the update
+	bucket := server.Resources["test_bucket"]
+	if bucket.BucketTokens != -5 || bucket.BucketUpdated != 1729954499 {
+		t.Errorf("expected bucket state to be kept, got %v tokens at %d", bucket.BucketTokens, bucket.BucketUpdated)
+	}
 }
 
 func TestDeleteResource(t *testing.T) {
 	storage := storage.NewDummyStorage()
 	server := server.NewServer(storage)
 
-	// Register a test resource
+	// Register a test resource, and a parent with a child
 	server.Resources = map[string]model.Resource{
 		"test_resource": {
 			Name:         "test_resource",
 			RequestCount: 10,
 			TimeFrame:    60,
 		},
+		"test_parent": {
+			Name:         "test_parent",
+			RequestCount: 100,
+			TimeFrame:    60,
+		},
+		"test_child": {
+			Name:         "test_child",
+			RequestCount: 10,
+			TimeFrame:    60,
+			Parent:       "test_parent",
+		},
 	}
 
 	// Test cases
@@ -212,6 +370,12 @@ func TestDeleteResource(t *testing.T) {
 			expectedStatus: http.StatusOK,
 			expectedOutput: "Resource test_resource deleted\n",
 		},
+		{
+			name:           "Parent with a child",
+			requestBody:    `{"name":"test_parent"}`,
+			expectedStatus: http.StatusConflict,
+			expectedOutput: "Resource has child resources\n",
+		},
 		{
 			name:           "Resource not found",
 			requestBody:    `{"name":"non_existent_resource"}`,
@@ -1,10 +1,16 @@
 package handlers
 
 import (
+	"cmp"
 	"encoding/json"
+	"math"
+	"meter_flow/metrics"
+	"meter_flow/model"
 	"meter_flow/scheduler"
 	"meter_flow/server"
 	"net/http"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -14,38 +20,359 @@ func ScheduleCalls(srv *server.Server) http.HandlerFunc {
 		var data struct {
 			ResourceName string `json:"resource_name"`
 			NumCalls     int    `json:"num_calls"`
+			Weight       *int   `json:"weight"`       // Token estimate for every call, 1 if missing
+			Weights      []int  `json:"weights"`      // Token estimate of each call, num_calls can be omitted
+			DryRun       bool   `json:"dry_run"`      // Only compute the delays, nothing is reserved
+			MaxDelay     int    `json:"max_delay"`    // Maximum delay of a call in seconds, 0 for no maximum
+			MaxDelayMs   int    `json:"max_delay_ms"` // Maximum delay of a call in milliseconds, 0 for no maximum
+			Deadline     int64  `json:"deadline"`     // Unix timestamp (in milliseconds) by which the calls must be made, 0 for none
+			Partial      bool   `json:"partial"`      // Only schedule the calls that fit the maximum delay, instead of none
+			Priority     string `json:"priority"`     // "high" (the default) or "low" for calls that can wait, like backfills
+			Tenant       string `json:"tenant"`       // Team or client sharing the resource with others, for a fair share of its limits
 		}
 
-		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.NumCalls <= 0 {
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil || data.MaxDelay < 0 || data.MaxDelayMs < 0 || data.Deadline < 0 || !validPriority(data.Priority) {
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
 		}
 
-		// Get the resource-specific mutex
-		resourceMutex, _ := srv.ResourceMutexes.LoadOrStore(data.ResourceName, &sync.Mutex{})
-		mu := resourceMutex.(*sync.Mutex)
-		mu.Lock()
-		defer mu.Unlock()
+		// A single weight and one weight per call are ambiguous together
+		weights, ok := callWeights(data.NumCalls, callWeight(data.Weight), data.Weights)
+		if !ok || (data.Weight != nil && len(data.Weights) > 0) {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		// Get the mutexes of the resource and its ancestors, whose limits also apply
+		chain, err := resourceChain(srv, data.ResourceName)
+		if err != nil {
+			storageUnavailable(w, err)
+			return
+		}
+		defer lockResources(srv, chain)()
 
-		resource, exists := srv.Resources[data.ResourceName]
+		// Get the current time and schedule new calls, updating the resources with the latest scheduled calls
+		now := time.Now().UnixMilli()
+		maxDelay, limited := maxDelayMillis(data.MaxDelay, data.MaxDelayMs, data.Deadline, now)
+		var delays []int
+		var reservations []string
+		tooHeavy := false
+		lastDelay := 0 // Delay of the last call, before dropping the calls that don't fit
+		exists, err := srv.UpdateResources(chain, func(resources []*model.Resource) bool {
+			if tooHeavy = exceedsTokenCount(resources, weights); tooHeavy {
+				return false
+			}
+			originals := make([]model.Resource, len(resources))
+			for i, resource := range resources {
+				originals[i] = *resource
+			}
+			delays = scheduleResource(resources, weights, data.Priority, data.Tenant, now, nil)
+			lastDelay = delays[len(delays)-1]
+
+			// The calls are scheduled in order, so the ones that fit the maximum delay come first
+			if fitting := fittingCalls(delays, maxDelay, limited); fitting < len(delays) {
+				if !data.Partial || fitting == 0 {
+					delays = nil
+					return false
+				}
+				for i := range resources {
+					*resources[i] = originals[i]
+				}
+				delays = scheduleResource(resources, weights[:fitting], data.Priority, data.Tenant, now, nil)
+			}
+			if data.DryRun {
+				return false
+			}
+			reservations = reserveCalls(resources[0], weights[:len(delays)], delays, data.Tenant, now)
+			return true
+		})
+		if err != nil {
+			storageUnavailable(w, err)
+			return
+		}
 		if !exists {
 			http.Error(w, "Resource not found", http.StatusNotFound)
 			return
 		}
+		if tooHeavy {
+			http.Error(w, "Weight exceeds the token count of the resource", http.StatusBadRequest)
+			return
+		}
 
-		// Get the current time and schedule new calls
-		now := time.Now().Unix()
-		delays, updatedCalls := scheduler.Schedule(data.NumCalls, resource.RequestCount, resource.TimeFrame, resource.ScheduledCalls, now)
-
-		// Update the resource with the latest scheduled calls
-		resource.ScheduledCalls = updatedCalls
-		srv.Resources[data.ResourceName] = resource
+		if delays == nil {
+			rejectCalls(w, maxDelay, lastDelay, data.Deadline, now)
+			return
+		}
 
 		response := map[string]interface{}{
-			"delays": delays,
+			"delays":    delaysInSeconds(delays),
+			"delays_ms": delays,
+		}
+		if len(delays) < len(weights) {
+			response["rejected"] = len(weights) - len(delays)
+		}
+		if data.DryRun {
+			response["dry_run"] = true
+		} else {
+			metrics.ObserveSchedule(data.ResourceName, delays)
+			response["reservations"] = reservations
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(response)
 	}
 }
+
+// maxDelayMillis returns the maximum delay of a call in milliseconds, the shortest of the given maximums and deadline.
+// It returns false if none is given.
+func maxDelayMillis(maxDelay, maxDelayMs int, deadline, now int64) (int64, bool) {
+	var limits []int64
+	if maxDelay > 0 {
+		limits = append(limits, int64(maxDelay)*1000)
+	}
+	if maxDelayMs > 0 {
+		limits = append(limits, int64(maxDelayMs))
+	}
+	if deadline > 0 {
+		limits = append(limits, deadline-now)
+	}
+	if len(limits) == 0 {
+		return 0, false
+	}
+	return slices.Min(limits), true
+}
+
+// fittingCalls returns the number of leading calls whose delay fits the maximum delay
+func fittingCalls(delays []int, maxDelay int64, limited bool) int {
+	if !limited {
+		return len(delays)
+	}
+	for i, delay := range delays {
+		if int64(delay) > maxDelay {
+			return i
+		}
+	}
+	return len(delays)
+}
+
+// rejectCalls answers a schedule request whose calls don't fit the maximum delay, with the earliest time
+// at which they could all be made. Without a deadline, the request can be retried once its delays have shrunk.
+func rejectCalls(w http.ResponseWriter, maxDelay int64, lastDelay int, deadline, now int64) {
+	response := map[string]interface{}{
+		"error":                "Calls exceed the maximum delay",
+		"earliest_feasible_at": now + int64(lastDelay),
+	}
+	if deadline == 0 {
+		retryAfter := max(0, int64(lastDelay)-maxDelay)
+		response["retry_after_ms"] = retryAfter
+		w.Header().Set("Retry-After", strconv.FormatInt((retryAfter+999)/1000, 10))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(response)
+}
+
+// exceedsTokenCount reports whether a call is heavier than a token count of the resources, it could never be scheduled
+func exceedsTokenCount(resources []*model.Resource, weights []int) bool {
+	for _, resource := range resources {
+		for _, limit := range resource.SlidingWindowLimits() {
+			if limit.TokenCount > 0 && slices.Max(weights) > limit.TokenCount {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// resourceChain returns the name of the resource followed by the names of its ancestors, from its parent to the root.
+// A resource that doesn't exist is returned alone.
+func resourceChain(srv *server.Server, name string) ([]string, error) {
+	chain := []string{name}
+	for {
+		resource, exists, err := srv.Resource(chain[len(chain)-1])
+		if err != nil {
+			return nil, err
+		}
+		if !exists || resource.Parent == "" || slices.Contains(chain, resource.Parent) {
+			return chain, nil
+		}
+		chain = append(chain, resource.Parent)
+	}
+}
+
+// lockResources locks the mutexes of the resources and returns a function unlocking them. The mutexes are always
+// locked in the order of the names, so that two requests locking the same resources can't wait for each other.
+func lockResources(srv *server.Server, names []string) func() {
+	sorted := slices.Clone(names)
+	slices.Sort(sorted)
+	sorted = slices.Compact(sorted)
+
+	mutexes := make([]*sync.Mutex, len(sorted))
+	for i, name := range sorted {
+		resourceMutex, _ := srv.ResourceMutexes.LoadOrStore(name, &sync.Mutex{})
+		mutexes[i] = resourceMutex.(*sync.Mutex)
+		mutexes[i].Lock()
+	}
+	return func() {
+		for i := len(mutexes) - 1; i >= 0; i-- {
+			mutexes[i].Unlock()
+		}
+	}
+}
+
+// scheduleResource schedules the weighted calls with the algorithm of the first resource, and returns their delays in
+// milliseconds. The calls must also satisfy the limits of the other resources, its ancestors. The calls of a tenant
+// only get the fair share of the limits of the tenant, beyond the shortest window from now. If given, each call is
+// delayed by at least its minimum delay, and no call is scheduled while one of the resources is paused.
+// The resources are updated with the new calls, the slices they held before are left untouched.
+func scheduleResource(resources []*model.Resource, weights []int, priority, tenant string, now int64, minDelays []int) []int {
+	resource := resources[0]
+	minDelays = pausedDelays(resources, minDelays, len(weights), now)
+	if resource.Algorithm == model.AlgorithmTokenBucket {
+		delays, tokens := scheduler.ScheduleTokenBucket(len(weights), resource.BucketCapacity, resource.RefillRate, resource.BucketTokens, resource.BucketUpdated, now)
+		resource.BucketTokens, resource.BucketUpdated = tokens, now
+
+		// Making a call later than its slot only leaves more tokens in the bucket
+		for i := range min(len(delays), len(minDelays)) {
+			delays[i] = max(delays[i], minDelays[i])
+		}
+		return delays
+	}
+
+	// One level for each resource, and two for the tenant: its cap and its share
+	var levels []scheduler.Level
+	for _, r := range resources {
+		levels = append(levels, scheduler.Level{Limits: r.PriorityLimits(priority), Calls: r.ScheduledCalls, Tokens: r.ScheduledTokens})
+	}
+	if tenant != "" {
+		// The cap holds from now on, even in the first window
+		if resource.TenantCap > 0 && resource.TenantCap < 1 {
+			calls, tokens := tenantCalls(*resource, tenant)
+			levels = append(levels, scheduler.Level{Limits: resource.TenantLimits(resource.TenantCap), Calls: calls, Tokens: tokens})
+		}
+		// The share only holds after the first window, so a tenant can use the capacity left free in it
+		if share := resource.TenantShare(tenant, now); share < 1 {
+			limits := resource.TenantLimits(share)
+			shortest := limits[0].TimeFrameMillis()
+			for _, limit := range limits {
+				shortest = min(shortest, limit.TimeFrameMillis())
+			}
+			calls, tokens := tenantCalls(*resource, tenant)
+			levels = append(levels, scheduler.Level{Limits: limits, Calls: calls, Tokens: tokens, From: now + shortest})
+		}
+	}
+
+	earliest := make([]int64, len(minDelays))
+	for i, delay := range minDelays {
+		earliest[i] = now + int64(delay)
+	}
+	delays, levels := scheduler.ScheduleLevelsAfter(weights, earliest, levels, now)
+	for i, r := range resources {
+		r.ScheduledCalls, r.ScheduledTokens = levels[i].Calls, levels[i].Tokens
+	}
+	return delays
+}
+
+// pausedDelays returns the minimum delays of the calls, raised so that none of them is made while a resource is paused
+func pausedDelays(resources []*model.Resource, minDelays []int, numCalls int, now int64) []int {
+	pausedUntil := now
+	for _, resource := range resources {
+		pausedUntil = max(pausedUntil, resource.PausedUntil)
+	}
+	if pausedUntil == now {
+		return minDelays
+	}
+
+	paused := make([]int, numCalls)
+	for i := range paused {
+		paused[i] = int(pausedUntil - now)
+		if i < len(minDelays) {
+			paused[i] = max(paused[i], minDelays[i])
+		}
+	}
+	return paused
+}
+
+// tenantCalls returns the calls reserved for a tenant and their weights, sorted by time
+func tenantCalls(resource model.Resource, tenant string) ([]int64, []int) {
+	var reservations []model.Reservation
+	for _, reservation := range resource.Reservations {
+		if reservation.Tenant == tenant {
+			reservations = append(reservations, reservation)
+		}
+	}
+	slices.SortFunc(reservations, func(a, b model.Reservation) int { return cmp.Compare(a.Timestamp, b.Timestamp) })
+
+	calls := make([]int64, len(reservations))
+	tokens := make([]int, len(reservations))
+	for i, reservation := range reservations {
+		calls[i] = reservation.Timestamp
+		tokens[i] = reservation.Weight
+	}
+	return calls, tokens
+}
+
+// releaseCall gives back the slot of a call scheduled at the given time in the resources (a resource and its ancestors),
+// so that later calls can use it
+func releaseCall(resources []*model.Resource, at int64, weight int) {
+	for _, resource := range resources {
+		switch resource.Algorithm {
+		case model.AlgorithmTokenBucket:
+			resource.BucketTokens = math.Min(resource.BucketTokens+1, float64(resource.BucketCapacity))
+		default:
+			resource.ScheduledCalls, resource.ScheduledTokens, _ = scheduler.ReleaseCall(resource.ScheduledCalls, resource.ScheduledTokens, at, weight)
+		}
+	}
+}
+
+// validPriority reports whether the priority of a request is known, no priority means high priority
+func validPriority(priority string) bool {
+	return priority == "" || priority == model.PriorityHigh || priority == model.PriorityLow
+}
+
+// defaultWeight is the token estimate of a call sent without a weight, so that it still counts against the token limits
+const defaultWeight = 1
+
+// callWeight returns the token estimate of a call, the default weight if missing
+func callWeight(weight *int) int {
+	if weight == nil {
+		return defaultWeight
+	}
+	return *weight
+}
+
+// callWeights returns the token estimate of each call to schedule, from either a single weight or one weight per call
+func callWeights(numCalls, weight int, weights []int) ([]int, bool) {
+	if len(weights) == 0 {
+		if numCalls <= 0 || weight < 0 {
+			return nil, false
+		}
+		weights = make([]int, numCalls)
+		for i := range weights {
+			weights[i] = weight
+		}
+		return weights, true
+	}
+
+	if numCalls != 0 && numCalls != len(weights) {
+		return nil, false
+	}
+	for _, w := range weights {
+		if w < 0 {
+			return nil, false
+		}
+	}
+	return weights, true
+}
+
+// delaysInSeconds rounds the millisecond delays up to whole seconds, so that no call is made too early. The rounded
+// delays are approximate: the slots are reserved at the exact delays, so a call made up to a second late can break the
+// limit along with the later calls.
+func delaysInSeconds(delays []int) []int {
+	seconds := make([]int, len(delays))
+	for i, delay := range delays {
+		seconds[i] = (delay + 999) / 1000
+	}
+	return seconds
+}
@@ -3,19 +3,36 @@ package handlers
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"meter_flow/server"
 	"meter_flow/storage"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
 )
 
 func TestScheduleCalls(t *testing.T) {
 	storage := storage.NewDummyStorage()
 	server := server.NewServer(storage)
 
-	// Register a test resource
+	// Register test resources
 	registerTestResource(t, server)
+	// A token bucket of 3 tokens refilled at 1 token per second
+	registerTestResourceBody(t, server, `{"name":"test_bucket", "algorithm":"token_bucket", "bucket_capacity":3, "refill_rate":1}`)
+	// An LLM API limited to 10 requests and 1000 tokens per minute
+	registerTestResourceBody(t, server, `{"name":"test_llm", "request_count":10, "token_count":1000, "time_frame":60}`)
+	// An API limited to 2 tokens per minute
+	registerTestResourceBody(t, server, `{"name":"test_tokens", "request_count":100, "token_count":2, "time_frame":60}`)
+	// An API limited to 1 request every 250 milliseconds
+	registerTestResourceBody(t, server, `{"name":"test_ms", "request_count":1, "time_frame_ms":250}`)
+	// An API limited to 2 requests per second and 3 requests per minute
+	registerTestResourceBody(t, server, `{"name":"test_stacked", "request_count":2, "time_frame":1, "limits":[{"request_count":3, "time_frame":60}]}`)
 
 	// Test cases
 	testCases := []struct {
@@ -23,6 +40,7 @@ func TestScheduleCalls(t *testing.T) {
 		requestBody    string
 		expectedStatus int
 		expectedOutput string
+		expectedDelays []int // Delays in milliseconds
 	}{
 		{
 			name:           "Valid schedule",
@@ -35,6 +53,54 @@ func TestScheduleCalls(t *testing.T) {
 			expectedStatus: http.StatusNotFound,
 			expectedOutput: "Resource not found\n",
 		},
+		{
+			name:           "Valid token bucket schedule",
+			requestBody:    `{"resource_name":"test_bucket", "num_calls":5}`,
+			expectedStatus: http.StatusOK,
+			expectedDelays: []int{0, 0, 0, 1000, 2000},
+		},
+		{
+			name:           "Valid weighted schedule",
+			requestBody:    `{"resource_name":"test_llm", "weights":[400, 400, 400]}`,
+			expectedStatus: http.StatusOK,
+			expectedDelays: []int{0, 0, 60000},
+		},
+		{
+			name:           "Valid stacked limits schedule",
+			requestBody:    `{"resource_name":"test_stacked", "num_calls":5}`,
+			expectedStatus: http.StatusOK,
+			expectedDelays: []int{0, 0, 1000, 60000, 60000},
+		},
+		{
+			name:           "Valid millisecond schedule",
+			requestBody:    `{"resource_name":"test_ms", "num_calls":6}`,
+			expectedStatus: http.StatusOK,
+			expectedDelays: []int{0, 250, 500, 750, 1000, 1250},
+		},
+		{
+			name:           "Weight exceeding the token count",
+			requestBody:    `{"resource_name":"test_llm", "num_calls":2, "weight":1500}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedOutput: "Weight exceeds the token count of the resource\n",
+		},
+		{
+			name:           "Missing weight counted as one token",
+			requestBody:    `{"resource_name":"test_tokens", "num_calls":3}`,
+			expectedStatus: http.StatusOK,
+			expectedDelays: []int{0, 0, 60000},
+		},
+		{
+			name:           "Both weight and weights",
+			requestBody:    `{"resource_name":"test_llm", "weight":100, "weights":[100, 100]}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedOutput: "Invalid request\n",
+		},
+		{
+			name:           "Mismatched weights",
+			requestBody:    `{"resource_name":"test_llm", "num_calls":2, "weights":[100]}`,
+			expectedStatus: http.StatusBadRequest,
+			expectedOutput: "Invalid request\n",
+		},
 		{
 			name:           "Invalid request",
 			requestBody:    `{"resource_name":"test_resource", "num_calls":-1}`,
@@ -67,10 +133,461 @@ func TestScheduleCalls(t *testing.T) {
 			if tc.expectedOutput != "" && rr.Body.String() != tc.expectedOutput {
 				t.Errorf("expected response body %q, got %q", tc.expectedOutput, rr.Body.String())
 			}
+
+			// Check the delays and reservations if expected
+			if tc.expectedDelays != nil {
+				var response struct {
+					DelaysMs     []int    `json:"delays_ms"`
+					Reservations []string `json:"reservations"`
+				}
+				if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+					t.Errorf("failed to decode response body: %v", err)
+				}
+				if !reflect.DeepEqual(response.DelaysMs, tc.expectedDelays) {
+					t.Errorf("expected delays %v, got %v", tc.expectedDelays, response.DelaysMs)
+				}
+				if len(response.Reservations) != len(tc.expectedDelays) {
+					t.Errorf("expected %d reservations, got %d", len(tc.expectedDelays), len(response.Reservations))
+				}
+			}
+		})
+	}
+}
+
+func TestScheduleCallsDryRun(t *testing.T) {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+
+	// An API limited to 2 requests per minute
+	registerTestResourceBody(t, server, `{"name":"test_resource", "request_count":2, "time_frame":60}`)
+
+	// Previewing the same batch twice gives the same delays, nothing is reserved
+	for i := 0; i < 2; i++ {
+		delays, reservations := scheduleTestCalls(t, server, `{"resource_name":"test_resource", "num_calls":3, "dry_run":true}`)
+		if !reflect.DeepEqual(delays, []int{0, 0, 60000}) {
+			t.Errorf("expected delays [0 0 60000], got %v", delays)
+		}
+		if len(reservations) != 0 {
+			t.Errorf("expected no reservations, got %v", reservations)
+		}
+	}
+	if calls := server.Resources["test_resource"].ScheduledCalls; len(calls) != 0 {
+		t.Errorf("expected no scheduled calls, got %d", len(calls))
+	}
+
+	// The batch is then scheduled for real
+	delays, reservations := scheduleTestCalls(t, server, `{"resource_name":"test_resource", "num_calls":3}`)
+	if delays[0] != 0 || len(reservations) != 3 {
+		t.Errorf("expected the first call to be scheduled immediately with 3 reservations, got %v and %v", delays, reservations)
+	}
+}
+
+func TestScheduleCallsMaxDelay(t *testing.T) {
+	deadline := time.Now().UnixMilli() + 30000
+
+	// Test cases, each one on a new API limited to 2 requests per minute
+	testCases := []struct {
+		name                 string
+		requestBody          string
+		expectedStatus       int
+		expectedDelays       []int
+		expectedRejected     int
+		expectedRetryAfterMs int64
+	}{
+		{
+			name:                 "Calls exceeding the maximum delay",
+			requestBody:          `{"resource_name":"test_resource", "num_calls":5, "max_delay":60}`,
+			expectedStatus:       http.StatusTooManyRequests,
+			expectedRetryAfterMs: 60000,
+		},
+		{
+			name:             "Partial schedule",
+			requestBody:      `{"resource_name":"test_resource", "num_calls":5, "max_delay":60, "partial":true}`,
+			expectedStatus:   http.StatusOK,
+			expectedDelays:   []int{0, 0, 60000, 60000},
+			expectedRejected: 1,
+		},
+		{
+			name:             "Partial schedule before a deadline",
+			requestBody:      fmt.Sprintf(`{"resource_name":"test_resource", "num_calls":5, "deadline":%d, "partial":true}`, deadline),
+			expectedStatus:   http.StatusOK,
+			expectedDelays:   []int{0, 0},
+			expectedRejected: 3,
+		},
+		{
+			name:           "Calls within the maximum delay",
+			requestBody:    `{"resource_name":"test_resource", "num_calls":5, "max_delay_ms":120000}`,
+			expectedStatus: http.StatusOK,
+			expectedDelays: []int{0, 0, 60000, 60000, 120000},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := server.NewServer(storage.NewDummyStorage())
+			registerTestResourceBody(t, server, `{"name":"test_resource", "request_count":2, "time_frame":60}`)
+
+			req, err := http.NewRequest("POST", "/schedule", bytes.NewBufferString(tc.requestBody))
+			if err != nil {
+				t.Errorf("failed to create request: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			handler := ScheduleCalls(server)
+			handler(rr, req)
+
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tc.expectedStatus, rr.Code)
+			}
+
+			var response struct {
+				DelaysMs     []int    `json:"delays_ms"`
+				Reservations []string `json:"reservations"`
+				Rejected     int      `json:"rejected"`
+				RetryAfterMs int64    `json:"retry_after_ms"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Errorf("failed to decode response body: %v", err)
+			}
+			if !reflect.DeepEqual(response.DelaysMs, tc.expectedDelays) || response.Rejected != tc.expectedRejected {
+				t.Errorf("expected delays %v with %d rejected, got %v with %d", tc.expectedDelays, tc.expectedRejected, response.DelaysMs, response.Rejected)
+			}
+			if response.RetryAfterMs != tc.expectedRetryAfterMs {
+				t.Errorf("expected to retry after %d ms, got %d", tc.expectedRetryAfterMs, response.RetryAfterMs)
+			}
+
+			// Only the granted calls are reserved
+			if calls := server.Resources["test_resource"].ScheduledCalls; len(calls) != len(tc.expectedDelays) {
+				t.Errorf("expected %d scheduled calls, got %d", len(tc.expectedDelays), len(calls))
+			}
 		})
 	}
 }
 
+func TestScheduleCallsPriority(t *testing.T) {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+
+	// An API limited to 10 requests per minute, keeping 20% for high priority calls
+	registerTestResourceBody(t, server, `{"name":"test_resource", "request_count":10, "time_frame":60, "high_priority_share":0.2}`)
+
+	// Test cases, run in order on the same resource
+	testCases := []struct {
+		name           string
+		requestBody    string
+		expectedDelays []int
+	}{
+		{
+			name:           "Low priority backfill",
+			requestBody:    `{"resource_name":"test_resource", "num_calls":10, "priority":"low"}`,
+			expectedDelays: []int{0, 0, 0, 0, 0, 0, 0, 0, 60000, 60000},
+		},
+		{
+			name:           "High priority calls use the kept share",
+			requestBody:    `{"resource_name":"test_resource", "num_calls":2, "priority":"high"}`,
+			expectedDelays: []int{0, 0},
+		},
+		{
+			name:           "Default priority calls wait for the full limit",
+			requestBody:    `{"resource_name":"test_resource", "num_calls":1}`,
+			expectedDelays: []int{60000},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			delays, _ := scheduleTestCalls(t, server, tc.requestBody)
+			if len(delays) != len(tc.expectedDelays) {
+				t.Fatalf("expected delays %v, got %v", tc.expectedDelays, delays)
+			}
+			for i, delay := range delays {
+				// The calls scheduled by an earlier request are a few milliseconds older
+				if delay > tc.expectedDelays[i] || delay < tc.expectedDelays[i]-1000 {
+					t.Errorf("expected delays %v, got %v", tc.expectedDelays, delays)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestScheduleCallsTenants(t *testing.T) {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+
+	// An API limited to 10 requests per minute, shared by two teams
+	registerTestResourceBody(t, server, `{"name":"test_resource", "request_count":10, "time_frame":60, "tenant_weights":{"team_a":1, "team_b":1}}`)
+
+	// Test cases, run in order on the same resource
+	testCases := []struct {
+		name           string
+		requestBody    string
+		expectedDelays []int
+	}{
+		{
+			name:           "Large batch of a first team",
+			requestBody:    `{"resource_name":"test_resource", "num_calls":20, "tenant":"team_a"}`,
+			expectedDelays: []int{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 60000, 60000, 60000, 60000, 60000, 120000, 120000, 120000, 120000, 120000},
+		},
+		{
+			name:           "Second team scheduled before the end of the batch",
+			requestBody:    `{"resource_name":"test_resource", "num_calls":2, "tenant":"team_b"}`,
+			expectedDelays: []int{60000, 60000},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			delays, _ := scheduleTestCalls(t, server, tc.requestBody)
+			if len(delays) != len(tc.expectedDelays) {
+				t.Fatalf("expected delays %v, got %v", tc.expectedDelays, delays)
+			}
+			for i, delay := range delays {
+				// The calls scheduled by an earlier request are a few milliseconds older
+				if delay > tc.expectedDelays[i] || delay < tc.expectedDelays[i]-1000 {
+					t.Errorf("expected delays %v, got %v", tc.expectedDelays, delays)
+					break
+				}
+			}
+		})
+	}
+
+	// The reservations remember their tenant
+	tenants := make(map[string]int)
+	for _, reservation := range server.Resources["test_resource"].Reservations {
+		tenants[reservation.Tenant]++
+	}
+	if tenants["team_a"] != 20 || tenants["team_b"] != 2 {
+		t.Errorf("expected 20 reservations for team_a and 2 for team_b, got %v", tenants)
+	}
+}
+
+func TestScheduleCallsUnknownTenants(t *testing.T) {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+
+	// An API limited to 10 requests per minute, without tenant weights
+	registerTestResourceBody(t, server, `{"name":"test_resource", "request_count":10, "time_frame":60}`)
+
+	// A first team alone uses the whole limit
+	delays, _ := scheduleTestCalls(t, server, `{"resource_name":"test_resource", "num_calls":30, "tenant":"team_a"}`)
+	expectedDelays := make([]int, 30)
+	for i := range expectedDelays {
+		expectedDelays[i] = i / 10 * 60000
+	}
+	if !reflect.DeepEqual(delays, expectedDelays) {
+		t.Errorf("expected delays %v, got %v", expectedDelays, delays)
+	}
+
+	// A second team showing up is scheduled after the calls already booked
+	delays, _ = scheduleTestCalls(t, server, `{"resource_name":"test_resource", "num_calls":2, "tenant":"team_b"}`)
+	for _, delay := range delays {
+		if delay > 180000 || delay < 179000 {
+			t.Errorf("expected the second team to be scheduled after the booked calls, got delays %v", delays)
+			break
+		}
+	}
+}
+
+func TestScheduleCallsTenantCap(t *testing.T) {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+
+	// An API limited to 10 requests per minute, no tenant can use more than a fifth of it
+	registerTestResourceBody(t, server, `{"name":"test_resource", "request_count":10, "time_frame":60, "tenant_cap":0.2}`)
+
+	// The cap already holds in the first window
+	delays, _ := scheduleTestCalls(t, server, `{"resource_name":"test_resource", "num_calls":10, "tenant":"team_a"}`)
+	expectedDelays := []int{0, 0, 60000, 60000, 120000, 120000, 180000, 180000, 240000, 240000}
+	if !reflect.DeepEqual(delays, expectedDelays) {
+		t.Errorf("expected delays %v, got %v", expectedDelays, delays)
+	}
+
+	// The rest of the first window is left to the other tenants
+	delays, _ = scheduleTestCalls(t, server, `{"resource_name":"test_resource", "num_calls":2, "tenant":"team_b"}`)
+	if !reflect.DeepEqual(delays, []int{0, 0}) {
+		t.Errorf("expected the second team to be scheduled right away, got delays %v", delays)
+	}
+}
+
+func TestScheduleCallsParent(t *testing.T) {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+
+	// An organization limited to 10 requests per minute, with two API keys of 8 requests per minute each
+	registerTestResourceBody(t, server, `{"name":"test_org", "request_count":10, "time_frame":60}`)
+	registerTestResourceBody(t, server, `{"name":"test_key_a", "request_count":8, "time_frame":60, "parent":"test_org"}`)
+	registerTestResourceBody(t, server, `{"name":"test_key_b", "request_count":8, "time_frame":60, "parent":"test_org"}`)
+
+	// Test cases, run in order on the same resources
+	testCases := []struct {
+		name           string
+		requestBody    string
+		expectedDelays []int
+	}{
+		{
+			name:           "First key limited by its own limit",
+			requestBody:    `{"resource_name":"test_key_a", "num_calls":9}`,
+			expectedDelays: []int{0, 0, 0, 0, 0, 0, 0, 0, 60000},
+		},
+		{
+			name:           "Second key limited by the organization",
+			requestBody:    `{"resource_name":"test_key_b", "num_calls":3}`,
+			expectedDelays: []int{0, 0, 60000},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			delays, _ := scheduleTestCalls(t, server, tc.requestBody)
+			if len(delays) != len(tc.expectedDelays) {
+				t.Fatalf("expected delays %v, got %v", tc.expectedDelays, delays)
+			}
+			for i, delay := range delays {
+				// The calls scheduled by an earlier request are a few milliseconds older
+				if delay > tc.expectedDelays[i] || delay < tc.expectedDelays[i]-1000 {
+					t.Errorf("expected delays %v, got %v", tc.expectedDelays, delays)
+					break
+				}
+			}
+		})
+	}
+
+	// The organization counts the calls of both keys
+	if calls := len(server.Resources["test_org"].ScheduledCalls); calls != 12 {
+		t.Errorf("expected 12 calls scheduled on the organization, got %d", calls)
+	}
+}
+
+func TestScheduleCallsSharedState(t *testing.T) {
+	// Two servers sharing their resources through the same Redis
+	redisServer := miniredis.RunT(t)
+	servers := []*server.Server{
+		server.NewServer(storage.NewRedisStorage(redis.NewClient(&redis.Options{Addr: redisServer.Addr()}))),
+		server.NewServer(storage.NewRedisStorage(redis.NewClient(&redis.Options{Addr: redisServer.Addr()}))),
+	}
+
+	// An API limited to 2 requests per minute, registered on the first server only
+	registerTestResourceBody(t, servers[0], `{"name":"test_resource", "request_count":2, "time_frame":60}`)
+
+	// Test cases, the calls are scheduled alternately on each server
+	testCases := []struct {
+		name          string
+		server        *server.Server
+		expectedDelay int
+	}{
+		{
+			name:          "First call on the first server",
+			server:        servers[0],
+			expectedDelay: 0,
+		},
+		{
+			name:          "Second call on the second server",
+			server:        servers[1],
+			expectedDelay: 0,
+		},
+		{
+			name:          "Third call on the first server",
+			server:        servers[0],
+			expectedDelay: 60000,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			delays, _ := scheduleTestCalls(t, tc.server, `{"resource_name":"test_resource", "num_calls":1}`)
+			if len(delays) != 1 || delays[0] < tc.expectedDelay-1000 || delays[0] > tc.expectedDelay {
+				t.Errorf("expected a delay of about %d ms, got %v", tc.expectedDelay, delays)
+			}
+		})
+	}
+
+	// A reservation made on one server is released on the other
+	_, reservations := scheduleTestCalls(t, servers[1], `{"resource_name":"test_resource", "num_calls":1}`)
+	released, err := releaseReservation(servers[0], reservations[0])
+	if err != nil || !released {
+		t.Errorf("expected the reservation to be released, got %v", err)
+	}
+}
+
+func TestScheduleCallsContention(t *testing.T) {
+	// Several servers sharing their resources through the same Redis, each one with several clients
+	redisServer := miniredis.RunT(t)
+	servers := make([]*server.Server, 6)
+	for i := range servers {
+		servers[i] = server.NewServer(storage.NewRedisStorage(redis.NewClient(&redis.Options{Addr: redisServer.Addr()})))
+	}
+
+	// An API limited to 20 requests per minute
+	registerTestResourceBody(t, servers[0], `{"name":"test_resource", "request_count":20, "time_frame":60}`)
+
+	// Every client schedules 2 calls at the same time, none of them fails
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		for range 5 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				scheduleTestCalls(t, server, `{"resource_name":"test_resource", "num_calls":2}`)
+			}()
+		}
+	}
+	wg.Wait()
+
+	// Every call was scheduled, and no minute holds more than 20 of them
+	resource, _, err := servers[0].Resource("test_resource")
+	if err != nil {
+		t.Fatalf("failed to load resource: %v", err)
+	}
+	calls := resource.ScheduledCalls
+	if len(calls) != 60 {
+		t.Fatalf("expected 60 calls scheduled, got %d", len(calls))
+	}
+	for i := 20; i < len(calls); i++ {
+		if calls[i]-calls[i-20] < 60000 {
+			t.Errorf("expected at most 20 calls per minute, got 21 within %d ms", calls[i]-calls[i-20])
+		}
+	}
+}
+
+func TestRegisterResourceSharedState(t *testing.T) {
+	// Several servers sharing their resources through the same Redis register the same resource at once
+	redisServer := miniredis.RunT(t)
+	var wg sync.WaitGroup
+	codes := make(chan int, 5)
+	for range 5 {
+		server := server.NewServer(storage.NewRedisStorage(redis.NewClient(&redis.Options{Addr: redisServer.Addr()})))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest("POST", "/resources", bytes.NewBufferString(`{"name":"test_resource", "request_count":20, "time_frame":60}`))
+			if err != nil {
+				t.Errorf("failed to create request: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			handler := RegisterResource(server)
+			handler(rr, req)
+			codes <- rr.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	// Only one of them registered it
+	created := 0
+	for code := range codes {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Errorf("expected status code %d or %d, got %d", http.StatusCreated, http.StatusConflict, code)
+		}
+	}
+	if created != 1 {
+		t.Errorf("expected the resource to be registered once, got %d", created)
+	}
+}
+
 func registerTestResource(t *testing.T, server *server.Server) {
 	// Register the "test_resource"
 	resourceData := struct {
@@ -101,3 +618,18 @@ func registerTestResource(t *testing.T, server *server.Server) {
 		t.Errorf("expected status code %d, got %d", http.StatusCreated, rr.Code)
 	}
 }
+
+func registerTestResourceBody(t *testing.T, server *server.Server, requestBody string) {
+	req, err := http.NewRequest("POST", "/resources", bytes.NewBufferString(requestBody))
+	if err != nil {
+		t.Errorf("failed to create request: %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	handler := RegisterResource(server)
+	handler(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Errorf("expected status code %d, got %d", http.StatusCreated, rr.Code)
+	}
+}
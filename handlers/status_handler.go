@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"encoding/json"
+	"meter_flow/model"
+	"meter_flow/scheduler"
+	"meter_flow/server"
+	"net/http"
+	"time"
+)
+
+// LimitStatusResponse is the live usage of one limit of a resource
+type LimitStatusResponse struct {
+	RequestCount    int   `json:"request_count"`
+	TokenCount      int   `json:"token_count,omitempty"`
+	TimeFrameMs     int64 `json:"time_frame_ms,omitempty"`
+	Used            int   `json:"used"`
+	Remaining       int   `json:"remaining"`
+	TokensUsed      int   `json:"tokens_used,omitempty"`
+	TokensRemaining int   `json:"tokens_remaining,omitempty"`
+	NextFreeAt      int64 `json:"next_free_at"`
+}
+
+// ResourceStatusResponse is the live usage of a resource, the timestamps are Unix milliseconds
+type ResourceStatusResponse struct {
+	Name        string                `json:"name"`
+	Algorithm   string                `json:"algorithm"`
+	Used        int                   `json:"used"`      // Calls in the current window of the main limit
+	Remaining   int                   `json:"remaining"` // Calls that can be made right away in every limit
+	NextFreeAt  int64                 `json:"next_free_at"`
+	NextFreeMs  int64                 `json:"next_free_ms"`
+	QueueEndAt  int64                 `json:"queue_end_at"` // Time of the last reserved call
+	QueueMs     int64                 `json:"queue_ms"`
+	PausedUntil int64                 `json:"paused_until,omitempty"` // Set while the resource is paused after the API throttled the calls
+	Limits      []LimitStatusResponse `json:"limits"`
+}
+
+// ResourceStatus reports how much of its limits a resource is using right now, and when the next call can be made
+func ResourceStatus(srv *server.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resource, exists, err := srv.Resource(r.PathValue("name"))
+		if err != nil {
+			storageUnavailable(w, err)
+			return
+		}
+		if !exists {
+			http.Error(w, "Resource not found", http.StatusNotFound)
+			return
+		}
+
+		now := time.Now().UnixMilli()
+		algorithm := resource.Algorithm
+		var status scheduler.Status
+		var limits []model.Limit
+		switch algorithm {
+		case model.AlgorithmTokenBucket:
+			status = scheduler.TokenBucketStatus(resource.BucketCapacity, resource.RefillRate, resource.BucketTokens, resource.BucketUpdated, now)
+			limits = []model.Limit{{RequestCount: resource.BucketCapacity}}
+		default:
+			algorithm = model.AlgorithmSlidingWindow
+			limits = resource.SlidingWindowLimits()
+			status = scheduler.SlidingWindowStatus(limits, resource.ScheduledCalls, resource.ScheduledTokens, now)
+		}
+
+		response := ResourceStatusResponse{
+			Name:       resource.Name,
+			Algorithm:  algorithm,
+			Used:       status.Limits[0].Used,
+			Remaining:  status.Limits[0].Remaining,
+			NextFreeAt: status.NextFree,
+			NextFreeMs: status.NextFree - now,
+			QueueEndAt: status.QueueEnd,
+			QueueMs:    status.QueueEnd - now,
+		}
+		if resource.PausedUntil > now {
+			response.PausedUntil = resource.PausedUntil
+			response.Remaining = 0
+			response.NextFreeAt = max(response.NextFreeAt, resource.PausedUntil)
+			response.NextFreeMs = response.NextFreeAt - now
+		}
+		for i, limitStatus := range status.Limits {
+			response.Remaining = min(response.Remaining, limitStatus.Remaining)
+			response.Limits = append(response.Limits, LimitStatusResponse{
+				RequestCount:    limits[i].RequestCount,
+				TokenCount:      limits[i].TokenCount,
+				TimeFrameMs:     limits[i].TimeFrameMillis(),
+				Used:            limitStatus.Used,
+				Remaining:       limitStatus.Remaining,
+				TokensUsed:      limitStatus.TokensUsed,
+				TokensRemaining: limitStatus.TokensRemaining,
+				NextFreeAt:      limitStatus.NextFree,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"encoding/json"
+	"meter_flow/server"
+	"meter_flow/storage"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResourceStatus(t *testing.T) {
+	storage := storage.NewDummyStorage()
+	server := server.NewServer(storage)
+
+	// An API limited to 2 requests per minute, with 3 calls scheduled
+	registerTestResourceBody(t, server, `{"name":"test_resource", "request_count":2, "time_frame":60}`)
+	scheduleTestCalls(t, server, `{"resource_name":"test_resource", "num_calls":3}`)
+
+	// Test cases
+	testCases := []struct {
+		name              string
+		resourceName      string
+		expectedStatus    int
+		expectedUsed      int
+		expectedRemaining int
+		expectedQueueMs   int64
+	}{
+		{
+			name:              "Saturated resource",
+			resourceName:      "test_resource",
+			expectedStatus:    http.StatusOK,
+			expectedUsed:      2,
+			expectedRemaining: 0,
+			expectedQueueMs:   60000,
+		},
+		{
+			name:           "Resource not found",
+			resourceName:   "non_existent_resource",
+			expectedStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Create a new HTTP request
+			req, err := http.NewRequest("GET", "/resources/"+tc.resourceName+"/status", nil)
+			if err != nil {
+				t.Errorf("failed to create request: %v", err)
+			}
+			req.SetPathValue("name", tc.resourceName)
+
+			// Create a new HTTP recorder
+			rr := httptest.NewRecorder()
+
+			// Call the ResourceStatus handler
+			handler := ResourceStatus(server)
+			handler(rr, req)
+
+			// Check the response status code
+			if rr.Code != tc.expectedStatus {
+				t.Errorf("expected status code %d, got %d", tc.expectedStatus, rr.Code)
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+
+			// Check the response body, the queue ends about a minute after the first calls
+			var response ResourceStatusResponse
+			if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+				t.Errorf("failed to decode response body: %v", err)
+			}
+			if response.Used != tc.expectedUsed || response.Remaining != tc.expectedRemaining {
+				t.Errorf("expected %d used and %d remaining, got %d and %d", tc.expectedUsed, tc.expectedRemaining, response.Used, response.Remaining)
+			}
+			if response.QueueMs < tc.expectedQueueMs-1000 || response.QueueMs > tc.expectedQueueMs {
+				t.Errorf("expected a queue of about %d ms, got %d", tc.expectedQueueMs, response.QueueMs)
+			}
+			if response.NextFreeMs <= 0 {
+				t.Errorf("expected the next free slot to be later, got %d ms", response.NextFreeMs)
+			}
+		})
+	}
+}
@@ -2,13 +2,21 @@ package main
 
 import (
 	"log"
+	"meter_flow/dispatch"
 	"meter_flow/handlers"
+	"meter_flow/metrics"
+	"meter_flow/middlewares"
 	"meter_flow/server"
 	"meter_flow/storage"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
 )
 
 func handleShutdown(server *server.Server) {
@@ -29,20 +37,114 @@ func handleShutdown(server *server.Server) {
 	}()
 }
 
+// reconcileResources creates, updates and prunes the resources to match the config file, and saves them
+func reconcileResources(server *server.Server, path string) error {
+	config, err := handlers.LoadResourceConfig(path)
+	if err != nil {
+		return err
+	}
+	result, err := handlers.ReconcileResources(server, config)
+	if err != nil {
+		return err
+	}
+	log.Printf("Resources reconciled with %s: created %v, updated %v, deleted %v, %d unchanged",
+		path, result.Created, result.Updated, result.Deleted, result.Unchanged)
+
+	// Storages recording each change as it happens are already up to date
+	if server.RecordsChanges() {
+		return nil
+	}
+	return server.Persist()
+}
+
+// handleReload reconciles the resources with the config file again on SIGHUP, after it was edited
+func handleReload(server *server.Server, path string) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	go func() {
+		for range sigChan {
+			if err := reconcileResources(server, path); err != nil {
+				log.Printf("Error reconciling resources with %s, keeping them as they are: %v", path, err)
+			}
+		}
+	}()
+}
+
+// newStorage returns the storage selected with the STORAGE environment variable
+func newStorage() storage.Storage {
+	switch os.Getenv("STORAGE") {
+	case "wal":
+		// record every change (including the scheduled calls) in a write-ahead log
+		return storage.NewWALStorage("resources.json", "resources.wal")
+	case "redis":
+		// share the resources and their scheduled calls with the other servers using the same Redis
+		url := os.Getenv("REDIS_URL")
+		if url == "" {
+			url = "redis://localhost:6379/0"
+		}
+		options, err := redis.ParseURL(url)
+		if err != nil {
+			log.Fatalf("Invalid REDIS_URL: %v", err)
+		}
+		return storage.NewRedisStorage(redis.NewClient(options))
+	case "", "file":
+		fileStorage := storage.NewFileStorage("resources.json")
+		// keep the calls still within their window across restarts
+		fileStorage.PersistScheduledCalls = os.Getenv("PERSIST_SCHEDULED_CALLS") == "true"
+		return fileStorage
+	default:
+		log.Fatalf("Unknown storage %q", os.Getenv("STORAGE"))
+		return nil
+	}
+}
+
 func main() {
-	storage := storage.NewFileStorage("resources.json")
+	storage := newStorage()
 	server := server.NewServer(storage)
 	// save the resources to disk upon shutdown
 	handleShutdown(server)
 
-	// "resources" endpoints
-	http.HandleFunc("POST /resources", handlers.RegisterResource(server))
-	http.HandleFunc("GET /resources", handlers.ListResources(server))
-	http.HandleFunc("PUT /resources", handlers.UpdateResource(server))
-	http.HandleFunc("DELETE /resources", handlers.DeleteResource(server))
+	// define the resources in a config file, applied on startup and on SIGHUP
+	if path := os.Getenv("RESOURCES_CONFIG"); path != "" {
+		if err := reconcileResources(server, path); err != nil {
+			log.Fatalf("Error reconciling resources with %s: %v", path, err)
+		}
+		handleReload(server, path)
+	}
+
+	// "resources" endpoints, the changes are saved to disk right away
+	http.HandleFunc("POST /resources", middlewares.WithMetrics("register_resource", middlewares.WithPersistence(server, handlers.RegisterResource(server))))
+	http.HandleFunc("GET /resources", middlewares.WithMetrics("list_resources", handlers.ListResources(server)))
+	http.HandleFunc("PUT /resources", middlewares.WithMetrics("update_resource", middlewares.WithPersistence(server, handlers.UpdateResource(server))))
+	http.HandleFunc("DELETE /resources", middlewares.WithMetrics("delete_resource", middlewares.WithPersistence(server, handlers.DeleteResource(server))))
+	http.HandleFunc("GET /resources/{name}/status", middlewares.WithMetrics("resource_status", handlers.ResourceStatus(server)))
+	http.HandleFunc("POST /resources/{name}/feedback", middlewares.WithMetrics("resource_feedback", handlers.ResourceFeedback(server)))
+
+	// "schedule" endpoints
+	http.HandleFunc("POST /schedule", middlewares.WithMetrics("schedule", handlers.ScheduleCalls(server)))
+	http.HandleFunc("POST /schedule/batch", middlewares.WithMetrics("schedule_batch", handlers.ScheduleBatch(server)))
+
+	// "reservations" endpoints, to give back the slots of calls that won't be made
+	http.HandleFunc("DELETE /reservations/{id}", middlewares.WithMetrics("release_reservation", handlers.ReleaseReservation(server)))
+	http.HandleFunc("DELETE /reservations", middlewares.WithMetrics("release_reservations", handlers.ReleaseReservations(server)))
+
+	// "acquire" endpoint, waits until the call can be made
+	http.HandleFunc("POST /acquire", middlewares.WithMetrics("acquire", handlers.AcquireSlot(server)))
+
+	// "jobs" endpoints, MeterFlow sends the requests itself
+	dispatcher := dispatch.NewDispatcher(&http.Client{Timeout: 30 * time.Second}, handlers.JobSlots(server))
+	http.HandleFunc("POST /jobs", middlewares.WithMetrics("submit_jobs", handlers.SubmitJobs(server, dispatcher)))
+	http.HandleFunc("GET /jobs/{id}", middlewares.WithMetrics("job_status", handlers.JobStatus(dispatcher)))
+	http.HandleFunc("DELETE /jobs/{id}", middlewares.WithMetrics("cancel_job", handlers.CancelJob(dispatcher)))
+
+	// "proxy" endpoint, forwards the requests to the upstream URL of the resource once it allows them
+	http.HandleFunc("/proxy/{resource}", middlewares.WithMetrics("proxy", handlers.ProxyRequest(server)))
+	http.HandleFunc("/proxy/{resource}/{path...}", middlewares.WithMetrics("proxy", handlers.ProxyRequest(server)))
 
-	// "schedule" endpoint
-	http.HandleFunc("POST /schedule", handlers.ScheduleCalls(server))
+	// "metrics" endpoint, for Prometheus
+	prometheus.MustRegister(metrics.NewResourceCollector(server))
+	http.Handle("GET /metrics", promhttp.Handler())
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -0,0 +1,105 @@
+package metrics
+
+import (
+	"log"
+	"meter_flow/server"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// ScheduledCalls counts the calls scheduled on each resource
+	ScheduledCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meterflow_scheduled_calls_total",
+		Help: "Number of calls scheduled on the resource.",
+	}, []string{"resource"})
+
+	// ScheduleDelays observes the delays given to the calls scheduled on each resource
+	ScheduleDelays = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "meterflow_schedule_delay_seconds",
+		Help:    "Delays given to the calls scheduled on the resource.",
+		Buckets: []float64{0, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600},
+	}, []string{"resource"})
+
+	// HTTPRequests counts the requests answered by each handler
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "meterflow_http_requests_total",
+		Help: "Number of HTTP requests answered, by handler, method and status code.",
+	}, []string{"handler", "method", "code"})
+
+	// HTTPDuration observes the time taken by each handler to answer, including the waits of the acquire endpoint
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "meterflow_http_request_duration_seconds",
+		Help:    "Time taken to answer HTTP requests, by handler and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"handler", "method"})
+)
+
+// ObserveSchedule records calls scheduled on a resource, with their delays in milliseconds
+func ObserveSchedule(resourceName string, delays []int) {
+	ScheduledCalls.WithLabelValues(resourceName).Add(float64(len(delays)))
+	histogram := ScheduleDelays.WithLabelValues(resourceName)
+	for _, delay := range delays {
+		histogram.Observe(float64(delay) / 1000)
+	}
+}
+
+var (
+	windowCallsDesc = prometheus.NewDesc(
+		"meterflow_resource_window_calls",
+		"Number of calls scheduled in the current window of the main limit of the resource, including the calls scheduled later.",
+		[]string{"resource"}, nil,
+	)
+	requestCountDesc = prometheus.NewDesc(
+		"meterflow_resource_request_count",
+		"Number of requests allowed per time frame by the resource.",
+		[]string{"resource"}, nil,
+	)
+	effectiveRequestCountDesc = prometheus.NewDesc(
+		"meterflow_resource_effective_request_count",
+		"Number of requests per time frame currently enforced for the resource, lower than its request count while an adaptive resource is throttled.",
+		[]string{"resource"}, nil,
+	)
+)
+
+// ResourceCollector reports the utilization of every resource of a server when the metrics are scraped
+type ResourceCollector struct {
+	srv *server.Server
+}
+
+func NewResourceCollector(srv *server.Server) *ResourceCollector {
+	return &ResourceCollector{srv: srv}
+}
+
+func (c *ResourceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- windowCallsDesc
+	ch <- requestCountDesc
+	ch <- effectiveRequestCountDesc
+}
+
+func (c *ResourceCollector) Collect(ch chan<- prometheus.Metric) {
+	snapshot, err := c.srv.Snapshot()
+	if err != nil {
+		log.Printf("Error collecting resource metrics: %v", err)
+		return
+	}
+
+	// The calls are counted in the window of the main limit, the one of the request count. The calls
+	// that already left the window are pruned only on the next schedule, they are skipped here.
+	now := time.Now().UnixMilli()
+	for name, resource := range snapshot {
+		start := now - resource.SlidingWindowLimits()[0].TimeFrameMillis()
+		calls := 0
+		for _, t := range resource.ScheduledCalls {
+			if t > start {
+				calls++
+			}
+		}
+
+		ch <- prometheus.MustNewConstMetric(windowCallsDesc, prometheus.GaugeValue, float64(calls), name)
+		ch <- prometheus.MustNewConstMetric(requestCountDesc, prometheus.GaugeValue, float64(resource.RequestCount), name)
+		ch <- prometheus.MustNewConstMetric(effectiveRequestCountDesc, prometheus.GaugeValue, float64(resource.EffectiveRequestCount()), name)
+	}
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"meter_flow/model"
+	"meter_flow/server"
+	"meter_flow/storage"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestResourceCollector(t *testing.T) {
+	now := time.Now().UnixMilli()
+	server := server.NewServer(storage.NewDummyStorage())
+
+	// A resource limited to 10 requests per minute, with a call that already left the window and 2 calls within it
+	server.SetResource(model.Resource{
+		Name:           "test_resource",
+		RequestCount:   10,
+		TimeFrame:      60,
+		ScheduledCalls: []int64{now - 120000, now - 1000, now + 5000},
+	})
+	// An adaptive resource throttled down to 25 of its 100 requests per minute
+	server.SetResource(model.Resource{
+		Name:                 "test_adaptive",
+		RequestCount:         100,
+		TimeFrame:            60,
+		Adaptive:             true,
+		AdaptiveRequestCount: 25,
+	})
+
+	expected := `
+# HELP meterflow_resource_effective_request_count Number of requests per time frame currently enforced for the resource, lower than its request count while an adaptive resource is throttled.
+# TYPE meterflow_resource_effective_request_count gauge
+meterflow_resource_effective_request_count{resource="test_adaptive"} 25
+meterflow_resource_effective_request_count{resource="test_resource"} 10
+# HELP meterflow_resource_request_count Number of requests allowed per time frame by the resource.
+# TYPE meterflow_resource_request_count gauge
+meterflow_resource_request_count{resource="test_adaptive"} 100
+meterflow_resource_request_count{resource="test_resource"} 10
+# HELP meterflow_resource_window_calls Number of calls scheduled in the current window of the main limit of the resource, including the calls scheduled later.
+# TYPE meterflow_resource_window_calls gauge
+meterflow_resource_window_calls{resource="test_adaptive"} 0
+meterflow_resource_window_calls{resource="test_resource"} 2
+`
+	if err := testutil.CollectAndCompare(NewResourceCollector(server), strings.NewReader(expected)); err != nil {
+		t.Errorf("unexpected metrics: %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+package middlewares
+
+import (
+	"meter_flow/metrics"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// WithMetrics counts the requests answered by a handler and observes how long it took to answer them
+func WithMetrics(handler string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		metrics.HTTPRequests.WithLabelValues(handler, r.Method, strconv.Itoa(rec.status)).Inc()
+		metrics.HTTPDuration.WithLabelValues(handler, r.Method).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,56 @@
+package middlewares
+
+import (
+	"meter_flow/metrics"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWithMetrics(t *testing.T) {
+	// Test cases
+	testCases := []struct {
+		name         string
+		method       string
+		status       int
+		expectedCode string
+	}{
+		{
+			name:         "Successful request",
+			method:       "POST",
+			status:       http.StatusOK,
+			expectedCode: "200",
+		},
+		{
+			name:         "Failed request",
+			method:       "POST",
+			status:       http.StatusNotFound,
+			expectedCode: "404",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			counter := metrics.HTTPRequests.WithLabelValues("test_handler", tc.method, tc.expectedCode)
+			before := testutil.ToFloat64(counter)
+
+			handler := WithMetrics("test_handler", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+			})
+
+			req, err := http.NewRequest(tc.method, "/test", nil)
+			if err != nil {
+				t.Errorf("failed to create request: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+
+			// The request is counted with its status code
+			if count := testutil.ToFloat64(counter) - before; count != 1 {
+				t.Errorf("expected the request to be counted once, got %v", count)
+			}
+		})
+	}
+}
@@ -1,22 +1,50 @@
 package middlewares
 
-// import (
-// 	"log"
-// 	"meter_flow/server"
-// 	"net/http"
-// )
-
-// func (s *server.Server) withPersistence(next http.HandlerFunc) http.HandlerFunc {
-//     return func(w http.ResponseWriter, r *http.Request) {
-//         // Execute the main handler
-//         next.ServeHTTP(w, r)
-
-//         // Only persist on write operations
-//         if r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodDelete {
-//             err := s.persistence.Save(&s.resources)
-//             if err != nil {
-//                 log.Println("Error saving resources:", err)
-//             }
-//         }
-//     }
-// }
+import (
+	"log"
+	"meter_flow/server"
+	"net/http"
+)
+
+// statusRecorder remembers the status code written by the wrapped handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap gives access to the wrapped response writer, so that streamed responses can still be flushed
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// WithPersistence saves the resources to disk after every successful write request,
+// so that a crash doesn't lose the resources registered since startup.
+func WithPersistence(srv *server.Server, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Execute the main handler
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+
+		// Storages recording each change as it happens are already up to date
+		if srv.RecordsChanges() {
+			return
+		}
+
+		// Only persist on successful write operations
+		if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodDelete {
+			return
+		}
+		if rec.status >= 300 {
+			return
+		}
+
+		if err := srv.Persist(); err != nil {
+			log.Println("Error saving resources:", err)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package middlewares
+
+import (
+	"meter_flow/model"
+	"meter_flow/server"
+	"meter_flow/storage"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithPersistence(t *testing.T) {
+	// Test cases
+	testCases := []struct {
+		name          string
+		method        string
+		status        int
+		expectedSaved bool
+	}{
+		{
+			name:          "Successful write",
+			method:        "POST",
+			status:        http.StatusCreated,
+			expectedSaved: true,
+		},
+		{
+			name:          "Failed write",
+			method:        "PUT",
+			status:        http.StatusNotFound,
+			expectedSaved: false,
+		},
+		{
+			name:          "Read",
+			method:        "GET",
+			status:        http.StatusOK,
+			expectedSaved: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			storage := storage.NewDummyStorage()
+			server := server.NewServer(storage)
+			// Nothing saved yet, the loaded map is now owned by the server
+			storage.Resources = make(map[string]model.Resource)
+
+			// The wrapped handler registers a resource and answers with the test case status
+			handler := WithPersistence(server, func(w http.ResponseWriter, r *http.Request) {
+				server.SetResource(model.Resource{Name: "test_resource", RequestCount: 10, TimeFrame: 60})
+				w.WriteHeader(tc.status)
+			})
+
+			req, err := http.NewRequest(tc.method, "/resources", nil)
+			if err != nil {
+				t.Errorf("failed to create request: %v", err)
+			}
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+
+			// Check the response status code
+			if rr.Code != tc.status {
+				t.Errorf("expected status code %d, got %d", tc.status, rr.Code)
+			}
+
+			// Check whether the resources were saved
+			if _, saved := storage.Resources["test_resource"]; saved != tc.expectedSaved {
+				t.Errorf("expected saved to be %t, got %t", tc.expectedSaved, saved)
+			}
+		})
+	}
+}
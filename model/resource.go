@@ -1,8 +1,165 @@
 package model
 
+// Supported rate limiting algorithms
+const (
+	AlgorithmSlidingWindow = "sliding_window"
+	AlgorithmTokenBucket   = "token_bucket"
+)
+
+// An adaptive resource divides its request count by AdaptiveDecrease on each throttled call,
+// and adds AdaptiveIncrease to it on each successful call, up to the request count it was registered with
+const (
+	AdaptiveDecrease = 2
+	AdaptiveIncrease = 1
+)
+
+// Priorities of the scheduled calls
+const (
+	PriorityHigh = "high"
+	PriorityLow  = "low"
+)
+
+// Limit is a single sliding window rule, a resource can stack several of them (per second, per minute, per day...)
+type Limit struct {
+	RequestCount int `json:"request_count"`           // Maximum requests allowed
+	TokenCount   int `json:"token_count,omitempty"`   // Maximum LLM tokens allowed, 0 for no token limit
+	TimeFrame    int `json:"time_frame,omitempty"`    // Time frame in seconds
+	TimeFrameMs  int `json:"time_frame_ms,omitempty"` // Time frame in milliseconds, takes precedence over TimeFrame
+}
+
+// TimeFrameMillis returns the time frame of the limit in milliseconds
+func (l Limit) TimeFrameMillis() int64 {
+	if l.TimeFrameMs > 0 {
+		return int64(l.TimeFrameMs)
+	}
+	return int64(l.TimeFrame) * 1000
+}
+
+// Reservation is a call scheduled for a client, it can be released if the call is not made
+type Reservation struct {
+	Timestamp int64  // Scheduled time (in milliseconds)
+	Weight    int    // Token estimate of the call
+	Tenant    string `json:",omitempty"` // Team or client the call was scheduled for, if any
+}
+
 type Resource struct {
-	Name           string
-	RequestCount   int     // Maximum requests allowed
-	TimeFrame      int     // Time frame in seconds
-	ScheduledCalls []int64 // Track scheduled timestamps for this resource
+	Name         string
+	Algorithm    string  // Rate limiting algorithm, sliding window if empty
+	RequestCount int     // Maximum requests allowed
+	TimeFrame    int     // Time frame in seconds
+	TimeFrameMs  int     // Time frame in milliseconds, takes precedence over TimeFrame
+	TokenCount   int     // Maximum LLM tokens allowed per time frame, 0 for no token limit
+	Limits       []Limit // Additional limits enforced together with the one above
+	Parent       string  // Resource whose limits also apply to the calls of this one (an organization for an API key), if any
+
+	Adaptive             bool // Whether RequestCount is only a ceiling, the actual limit following the feedback of the API
+	AdaptiveRequestCount int  // Request count of an adaptive resource, between 1 and RequestCount, RequestCount if 0
+
+	UpstreamURL string // Base URL of the API the proxy forwards the calls of the resource to, if any
+
+	HighPriorityShare float64 // Share of every limit (between 0 and 1) that low priority calls leave free for high priority ones
+
+	TenantCap     float64            // Largest share of every limit (between 0 and 1) a single tenant can use, 0 for no cap
+	TenantWeights map[string]float64 // Weight of each tenant in the fair share of the limits, 1 if missing
+
+	ScheduledCalls  []int64 // Track scheduled timestamps (in milliseconds) for this resource
+	ScheduledTokens []int   // Token estimate of each scheduled call, parallel to ScheduledCalls
+
+	Reservations map[string]Reservation // Scheduled calls that can still be released, by reservation ID
+
+	PausedUntil int64 // Unix timestamp (in milliseconds) before which no call is scheduled, after the API throttled the calls
+
+	// Token bucket settings and state
+	BucketCapacity int     // Maximum number of tokens (burst size)
+	RefillRate     float64 // Tokens added per second
+	BucketTokens   float64 // Tokens left at BucketUpdated, negative when calls are queued
+	BucketUpdated  int64   // Unix timestamp (in milliseconds) of the last bucket update
+}
+
+// SlidingWindowLimits returns every limit of the resource, starting with the main one
+func (r Resource) SlidingWindowLimits() []Limit {
+	limits := []Limit{{RequestCount: r.EffectiveRequestCount(), TokenCount: r.TokenCount, TimeFrame: r.TimeFrame, TimeFrameMs: r.TimeFrameMs}}
+	return append(limits, r.Limits...)
+}
+
+// EffectiveRequestCount returns the request count the calls are scheduled with, lower than RequestCount for an
+// adaptive resource whose calls were throttled
+func (r Resource) EffectiveRequestCount() int {
+	if r.Adaptive && r.AdaptiveRequestCount > 0 {
+		return r.AdaptiveRequestCount
+	}
+	return r.RequestCount
+}
+
+// PriorityLimits returns the sliding window limits that the calls of the given priority must fit in.
+// Low priority calls only get the part of each limit that isn't kept for high priority calls.
+func (r Resource) PriorityLimits(priority string) []Limit {
+	limits := r.SlidingWindowLimits()
+	if priority != PriorityLow || r.HighPriorityShare == 0 {
+		return limits
+	}
+	return scaleLimits(limits, 1-r.HighPriorityShare)
+}
+
+// TenantShare returns the share of the limits the tenant can use: its weight among the tenants with calls
+// still in a window, the tenants with a weight (even without calls) and itself, capped by the tenant cap
+func (r Resource) TenantShare(tenant string, now int64) float64 {
+	start := now - r.LongestTimeFrameMillis()
+	active := map[string]bool{tenant: true}
+	for name := range r.TenantWeights {
+		active[name] = true
+	}
+	for _, reservation := range r.Reservations {
+		if reservation.Tenant != "" && reservation.Timestamp > start {
+			active[reservation.Tenant] = true
+		}
+	}
+
+	total := 0.0
+	for name := range active {
+		total += r.TenantWeight(name)
+	}
+	share := r.TenantWeight(tenant) / total
+	if r.TenantCap > 0 {
+		share = min(share, r.TenantCap)
+	}
+	return share
+}
+
+// TenantWeight returns the weight of the tenant in the fair share of the limits
+func (r Resource) TenantWeight(tenant string) float64 {
+	if weight, exists := r.TenantWeights[tenant]; exists {
+		return weight
+	}
+	return 1
+}
+
+// TenantLimits returns the sliding window limits that the calls of a tenant with the given share must fit in
+func (r Resource) TenantLimits(share float64) []Limit {
+	return scaleLimits(r.SlidingWindowLimits(), share)
+}
+
+// scaleLimits scales the request and token counts of the limits, which are modified in place
+func scaleLimits(limits []Limit, factor float64) []Limit {
+	for i, limit := range limits {
+		// At least one call can always be made, otherwise some calls would never be scheduled
+		limits[i].RequestCount = max(1, int(float64(limit.RequestCount)*factor))
+		if limit.TokenCount > 0 {
+			limits[i].TokenCount = max(1, int(float64(limit.TokenCount)*factor))
+		}
+	}
+	return limits
+}
+
+// LongestTimeFrameMillis returns how long a scheduled call keeps limiting the resource, in milliseconds
+func (r Resource) LongestTimeFrameMillis() int64 {
+	if r.Algorithm == AlgorithmTokenBucket {
+		return 0
+	}
+
+	longest := int64(0)
+	for _, limit := range r.SlidingWindowLimits() {
+		longest = max(longest, limit.TimeFrameMillis())
+	}
+	return longest
 }
@@ -1,7 +1,19 @@
 package scheduler
 
+import (
+	"meter_flow/model"
+	"slices"
+	"sort"
+)
+
+// window is a sliding window limit, its length is in the same time unit as the timestamps
+type window struct {
+	requestCount int
+	tokenCount   int
+	length       int64
+}
+
 // schedule schedules a set of new requests based on a sliding window rate limiting algorithm.
-// TODO: Support other algorithms (?)
 //
 // Parameters:
 //
@@ -16,43 +28,302 @@ package scheduler
 // delays ([]int): A slice of delays (in seconds) for each new request.
 // previousCalls ([]int64): The updated slice of previous requests, including the new ones.func schedule(numCalls, requestCount, timeFrame int, previousCalls []int64, now int64) ([]int, []int64) {
 func Schedule(numCalls, requestCount, timeFrame int, previousCalls []int64, now int64) ([]int, []int64) {
+	delays, previousCalls, _ := ScheduleWeighted(make([]int, numCalls), requestCount, 0, timeFrame, previousCalls, nil, now)
+	return delays, previousCalls
+}
+
+// ScheduleWeighted schedules a set of new weighted requests based on a sliding window rate limiting algorithm.
+// Each request carries a weight (for instance the number of LLM tokens it is expected to use), and a request
+// is only scheduled once both the request count and the total weight within the time window fit the limits.
+//
+// Parameters:
+//
+// weights ([]int): The weight of each new request to schedule.
+// requestCount (int): The maximum number of requests allowed within the specified time frame.
+// tokenCount (int): The maximum total weight allowed within the specified time frame, 0 for no limit.
+// timeFrame (int): The duration in seconds of the sliding time window.
+// previousCalls ([]int64): A slice of Unix timestamps (in seconds) representing the previous requests.
+// previousTokens ([]int): The weights of the previous requests, missing weights count as 0.
+// now (int64): The current Unix timestamp (in seconds).
+//
+// Returns:
+//
+// delays ([]int): A slice of delays (in seconds) for each new request.
+// previousCalls ([]int64): The updated slice of previous requests, including the new ones.
+// previousTokens ([]int): The updated weights of the previous requests, including the new ones.
+func ScheduleWeighted(weights []int, requestCount, tokenCount, timeFrame int, previousCalls []int64, previousTokens []int, now int64) ([]int, []int64, []int) {
+	windows := []window{{requestCount: requestCount, tokenCount: tokenCount, length: int64(timeFrame)}}
+	return scheduleWindows(weights, windows, previousCalls, previousTokens, now)
+}
+
+// ScheduleLimits schedules a set of new weighted requests so that every sliding window limit is satisfied at once,
+// for instance 10 requests per second, 500 requests per minute and 10000 requests per day.
+// Unlike Schedule and ScheduleWeighted, it works with millisecond precision.
+//
+// Parameters:
+//
+// weights ([]int): The weight of each new request to schedule.
+// limits ([]model.Limit): The limits to satisfy, each one with its request count, token count and time frame.
+// previousCalls ([]int64): A slice of Unix timestamps (in milliseconds) representing the previous requests.
+// previousTokens ([]int): The weights of the previous requests, missing weights count as 0.
+// now (int64): The current Unix timestamp (in milliseconds).
+//
+// Returns:
+//
+// delays ([]int): A slice of delays (in milliseconds) for each new request.
+// previousCalls ([]int64): The updated slice of previous requests, including the new ones.
+// previousTokens ([]int): The updated weights of the previous requests, including the new ones.
+func ScheduleLimits(weights []int, limits []model.Limit, previousCalls []int64, previousTokens []int, now int64) ([]int, []int64, []int) {
+	return scheduleWindows(weights, limitWindows(limits), previousCalls, previousTokens, now)
+}
+
+// Level is a group of scheduled calls sharing limits, for instance a resource, one of its tenants or its parent
+type Level struct {
+	Limits []model.Limit // Limits the calls of the level must satisfy
+	Calls  []int64       // Unix timestamps (in milliseconds) of the previous requests of the level, sorted
+	Tokens []int         // Weights of the previous requests, missing weights count as 0
+	From   int64         // Unix timestamp (in milliseconds) from which the limits apply, 0 for always
+}
+
+// ScheduleLevels schedules a set of new weighted requests so that they satisfy the limits of every level at once,
+// each level counting its own previous requests. For instance a request on an API key must satisfy the limits of the
+// key and the ones of its organization. It works with millisecond precision.
+//
+// Parameters:
+//
+// weights ([]int): The weight of each new request to schedule.
+// levels ([]Level): The levels the requests belong to, with their limits and previous requests.
+// now (int64): The current Unix timestamp (in milliseconds).
+//
+// Returns:
+//
+// delays ([]int): A slice of delays (in milliseconds) for each new request.
+// levels ([]Level): The levels with their updated previous requests, including the new ones.
+func ScheduleLevels(weights []int, levels []Level, now int64) ([]int, []Level) {
+	return ScheduleLevelsAfter(weights, nil, levels, now)
+}
+
+// ScheduleLevelsAfter works like ScheduleLevels, but no new request is scheduled before its earliest time, for instance
+// to keep the steps of a pipeline in order. The earliest times are Unix timestamps (in milliseconds), one per request,
+// and the requests without one can be scheduled from now.
+func ScheduleLevelsAfter(weights []int, earliest []int64, levels []Level, now int64) ([]int, []Level) {
+	sets := make([]*callSet, len(levels))
+	for i, level := range levels {
+		sets[i] = &callSet{calls: level.Calls, tokens: level.Tokens, windows: limitWindows(level.Limits), from: level.From}
+	}
+	delays := scheduleSets(weights, earliest, sets, now)
+
+	updated := make([]Level, len(levels))
+	for i, level := range levels {
+		level.Calls, level.Tokens = sets[i].calls, sets[i].tokens
+		updated[i] = level
+	}
+	return delays, updated
+}
+
+// callSet holds scheduled calls, with the windows they must fit in from a given time on
+type callSet struct {
+	calls   []int64
+	tokens  []int
+	windows []window
+	from    int64
+}
+
+// limitWindows returns the windows of the limits, in milliseconds
+func limitWindows(limits []model.Limit) []window {
+	windows := make([]window, 0, len(limits))
+	for _, limit := range limits {
+		windows = append(windows, window{requestCount: limit.RequestCount, tokenCount: limit.TokenCount, length: limit.TimeFrameMillis()})
+	}
+	return windows
+}
+
+// scheduleWindows schedules the weighted requests so that every window is satisfied, in any time unit.
+func scheduleWindows(weights []int, windows []window, previousCalls []int64, previousTokens []int, now int64) ([]int, []int64, []int) {
+	set := &callSet{calls: previousCalls, tokens: previousTokens, windows: windows}
+	delays := scheduleSets(weights, nil, []*callSet{set}, now)
+	return delays, set.calls, set.tokens
+}
+
+// scheduleSets schedules the weighted requests so that the windows of every set of calls are satisfied, and no request
+// is scheduled before its earliest time, if any. The sets are updated with the new calls, the slices they held before
+// are left untouched.
+func scheduleSets(weights []int, earliest []int64, sets []*callSet, now int64) []int {
 	var delays []int
 
-	// Prune previous calls to only keep those within the current time frame
-	previousCalls = filterRecentCalls(previousCalls, now-int64(timeFrame))
+	// Prune previous calls to only keep those within the longest time frame
+	for _, set := range sets {
+		set.calls, set.tokens = filterRecentCalls(set.calls, set.tokens, now-longestWindow(set.windows))
+	}
+
+	// The calls of a request are scheduled in order, but the first one can fill a slot
+	// left free before previously scheduled calls (for instance by a released call).
+	// Moving forward for a set can break another one, so the sets are checked until none moves.
+	t := now
+	for i, weight := range weights {
+		if i < len(earliest) {
+			t = max(t, earliest[i])
+		}
+		for moved := true; moved; {
+			moved = false
+			for _, set := range sets {
+				if t < set.from {
+					continue
+				}
+				if next := nextSlot(set.calls, set.tokens, set.windows, weight, t); next != t {
+					t, moved = next, true
+				}
+			}
+		}
+		delays = append(delays, int(t-now))
+
+		// Keep the scheduled calls sorted
+		for _, set := range sets {
+			set.calls, set.tokens = insertCall(set.calls, set.tokens, t, weight)
+		}
+	}
 
-	// Calculate available slots
-	currentCalls := len(previousCalls)
-	availableSlots := requestCount - currentCalls
+	return delays
+}
 
-	// Schedule new calls
-	for i := 0; i < numCalls; i++ {
-		if availableSlots > 0 {
-			// No delay if slots are available
-			delays = append(delays, 0)
-			previousCalls = append(previousCalls, now)
-			availableSlots--
-		} else {
-			// Calculate delay for the next available slot
-			nextAvailableTime := previousCalls[0] + int64(timeFrame)
-			delay := int(nextAvailableTime - now)
-			delays = append(delays, delay)
+// insertCall inserts a call after the calls scheduled at or before it
+func insertCall(calls []int64, tokens []int, t int64, weight int) ([]int64, []int) {
+	i := sort.Search(len(calls), func(i int) bool { return calls[i] > t })
+	return slices.Insert(calls, i, t), slices.Insert(tokens, i, weight)
+}
 
-			// Shift the oldest call to the new scheduled time
-			previousCalls = append(previousCalls[1:], nextAvailableTime)
+// longestWindow returns the length of the longest window
+func longestWindow(windows []window) int64 {
+	longest := int64(0)
+	for _, w := range windows {
+		longest = max(longest, w.length)
+	}
+	return longest
+}
+
+// nextSlot returns the earliest time from t at which one more call of the given weight fits in every window.
+// Moving forward only removes calls from the window ending at t, so the loop stops once no window moves t.
+func nextSlot(calls []int64, tokens []int, windows []window, weight int, t int64) int64 {
+	for {
+		next := t
+		for _, w := range windows {
+			next = max(next, nextRequestSlot(calls, w.requestCount, w.length, next))
+			if w.tokenCount > 0 {
+				next = max(next, nextTokenSlot(calls, tokens, w.tokenCount, weight, w.length, next))
+			}
+			next = max(next, nextLaterSlot(calls, tokens, w, weight, next))
 		}
+		if next == t {
+			return t
+		}
+		t = next
 	}
+}
 
-	return delays, previousCalls
+// ReleaseCall removes a scheduled call and its weight, so that its slot can be reused by later calls.
+// The calls scheduled after it stay valid since removing a call only frees capacity.
+//
+// Parameters:
+//
+// calls ([]int64): A slice of Unix timestamps representing the scheduled requests.
+// tokens ([]int): The weights of the scheduled requests, missing weights count as 0.
+// at (int64): The Unix timestamp of the call to release.
+// weight (int): The weight of the call to release.
+//
+// Returns:
+//
+// calls ([]int64): The updated slice of scheduled requests, without the released one.
+// tokens ([]int): The updated weights of the scheduled requests.
+// released (bool): Whether a matching call was found.
+func ReleaseCall(calls []int64, tokens []int, at int64, weight int) ([]int64, []int, bool) {
+	for i := len(calls) - 1; i >= 0; i-- {
+		callWeight := 0
+		if i < len(tokens) {
+			callWeight = tokens[i]
+		}
+		if calls[i] != at || callWeight != weight {
+			continue
+		}
+
+		// Copy the slices, the caller may still hold the previous ones
+		calls = append(calls[:i:i], calls[i+1:]...)
+		if i < len(tokens) {
+			tokens = append(tokens[:i:i], tokens[i+1:]...)
+		}
+		return calls, tokens, true
+	}
+	return calls, tokens, false
+}
+
+// nextRequestSlot returns the earliest time from t at which one more call fits within the request count.
+func nextRequestSlot(calls []int64, requestCount int, length, t int64) int64 {
+	first, end := windowBounds(calls, length, t)
+	if excess := end - first - requestCount; excess >= 0 {
+		// Wait for the oldest calls in the window to leave it
+		return calls[first+excess] + length
+	}
+	return t
+}
+
+// nextTokenSlot returns the earliest time from t at which one more call of the given weight fits within the token count.
+func nextTokenSlot(calls []int64, tokens []int, tokenCount, weight int, length, t int64) int64 {
+	first, end := windowBounds(calls, length, t)
+	used := 0
+	for i := first; i < end; i++ {
+		used += tokens[i]
+	}
+
+	// Wait for the oldest calls in the window to leave it until the new weight fits
+	for i := first; used+weight > tokenCount && i < end; i++ {
+		used -= tokens[i]
+		t = calls[i] + length
+	}
+	return t
+}
+
+// nextLaterSlot checks the windows of the calls scheduled after t that would include a call at t. If one of
+// them is already full, no call can be made from its start until that call, so the earliest candidate is that call.
+func nextLaterSlot(calls []int64, tokens []int, w window, weight int, t int64) int64 {
+	_, end := windowBounds(calls, w.length, t)
+	for j := end; j < len(calls) && calls[j] < t+w.length; j++ {
+		first, last := windowBounds(calls, w.length, calls[j])
+		if last-first+1 > w.requestCount {
+			return calls[j]
+		}
+
+		if w.tokenCount > 0 {
+			used := weight
+			for i := first; i < last; i++ {
+				used += tokens[i]
+			}
+			if used > w.tokenCount {
+				return calls[j]
+			}
+		}
+	}
+	return t
+}
+
+// windowBounds returns the range of calls within the time window ending at t.
+func windowBounds(calls []int64, length, t int64) (int, int) {
+	first := sort.Search(len(calls), func(i int) bool { return calls[i] > t-length })
+	end := sort.Search(len(calls), func(i int) bool { return calls[i] > t })
+	return first, end
 }
 
-// filterRecentCalls filters timestamps to keep only those within the current time frame.
-func filterRecentCalls(calls []int64, start int64) []int64 {
+// filterRecentCalls filters timestamps (and their weights) to keep only those within the current time frame.
+func filterRecentCalls(calls []int64, tokens []int, start int64) ([]int64, []int) {
 	var filtered []int64
-	for _, t := range calls {
+	var filteredTokens []int
+	for i, t := range calls {
 		if t > start {
 			filtered = append(filtered, t)
+			if i < len(tokens) {
+				filteredTokens = append(filteredTokens, tokens[i])
+			} else {
+				filteredTokens = append(filteredTokens, 0)
+			}
 		}
 	}
-	return filtered
+	return filtered, filteredTokens
 }
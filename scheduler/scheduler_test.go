@@ -1,6 +1,7 @@
 package scheduler
 
 import (
+	"meter_flow/model"
 	"reflect"
 	"testing"
 )
@@ -86,3 +87,292 @@ func TestSequentialScheduling(t *testing.T) {
 		t.Errorf("Third schedule call = %v; want %v", delays, expectedThird)
 	}
 }
+
+func TestScheduleWeighted(t *testing.T) {
+	tests := []struct {
+		weights      []int
+		requestCount int
+		tokenCount   int
+		timeFrame    int
+		expected     []int
+	}{
+		{
+			// The token count is the limiting factor
+			weights:      []int{400, 400, 400, 400, 400},
+			requestCount: 10,
+			tokenCount:   1000,
+			timeFrame:    60,
+			expected:     []int{0, 0, 60, 60, 120},
+		},
+		{
+			// The request count is the limiting factor
+			weights:      []int{10, 10, 10, 10, 10},
+			requestCount: 2,
+			tokenCount:   1000,
+			timeFrame:    60,
+			expected:     []int{0, 0, 60, 60, 120},
+		},
+		{
+			// A heavy call waits until enough light calls have left the window
+			weights:      []int{300, 300, 300, 900, 100},
+			requestCount: 10,
+			tokenCount:   1000,
+			timeFrame:    60,
+			expected:     []int{0, 0, 0, 60, 60},
+		},
+		{
+			// No token limit
+			weights:      []int{5000, 5000, 5000},
+			requestCount: 2,
+			tokenCount:   0,
+			timeFrame:    1,
+			expected:     []int{0, 0, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		delays, calls, tokens := ScheduleWeighted(tt.weights, tt.requestCount, tt.tokenCount, tt.timeFrame, []int64{}, []int{}, 1729954499)
+		if !reflect.DeepEqual(delays, tt.expected) {
+			t.Errorf("ScheduleWeighted(%v, %d, %d, %d) = %v; want %v", tt.weights, tt.requestCount, tt.tokenCount, tt.timeFrame, delays, tt.expected)
+		}
+		if len(calls) != len(tokens) {
+			t.Errorf("expected as many weights as calls, got %d weights for %d calls", len(tokens), len(calls))
+		}
+	}
+}
+
+func TestSequentialWeightedScheduling(t *testing.T) {
+	// 10 calls and 1000 tokens per minute
+	requestCount := 10
+	tokenCount := 1000
+	timeFrame := 60
+	now := int64(0)
+
+	// First scheduling call uses most of the token budget
+	expectedFirst := []int{0, 0}
+	delays, calls, tokens := ScheduleWeighted([]int{400, 400}, requestCount, tokenCount, timeFrame, []int64{}, []int{}, now)
+	if !reflect.DeepEqual(delays, expectedFirst) {
+		t.Errorf("First schedule call = %v; want %v", delays, expectedFirst)
+	}
+
+	// Wait for 30 seconds
+	now += 30
+
+	// Second scheduling call, the small call fits, the big one waits for the first calls to leave the window
+	expectedSecond := []int{0, 30}
+	delays, calls, tokens = ScheduleWeighted([]int{100, 500}, requestCount, tokenCount, timeFrame, calls, tokens, now)
+	if !reflect.DeepEqual(delays, expectedSecond) {
+		t.Errorf("Second schedule call = %v; want %v", delays, expectedSecond)
+	}
+
+	// Previous calls without weights count as 0 tokens
+	delays, _, _ = ScheduleWeighted([]int{1000}, requestCount, tokenCount, timeFrame, []int64{0, 0}, nil, 30)
+	if !reflect.DeepEqual(delays, []int{0}) {
+		t.Errorf("Unweighted previous calls schedule = %v; want %v", delays, []int{0})
+	}
+}
+
+func TestScheduleLimits(t *testing.T) {
+	// 2 calls per second, 5 calls per minute and 8 calls per hour
+	limits := []model.Limit{
+		{RequestCount: 2, TimeFrame: 1},
+		{RequestCount: 5, TimeFrame: 60},
+		{RequestCount: 8, TimeFrame: 3600},
+	}
+
+	expected := []int{0, 0, 1000, 1000, 2000, 60000, 60000, 61000, 3600000, 3600000}
+	delays, _, _ := ScheduleLimits(make([]int, 10), limits, []int64{}, []int{}, 1729954499000)
+	if !reflect.DeepEqual(delays, expected) {
+		t.Errorf("ScheduleLimits(10, %v) = %v; want %v", limits, delays, expected)
+	}
+
+	// Stacked token limits, 1000 tokens per minute and 1500 tokens per hour
+	limits = []model.Limit{
+		{RequestCount: 10, TokenCount: 1000, TimeFrame: 60},
+		{RequestCount: 100, TokenCount: 1500, TimeFrame: 3600},
+	}
+
+	expected = []int{0, 0, 60000, 3600000}
+	delays, _, _ = ScheduleLimits([]int{500, 500, 500, 500}, limits, []int64{}, []int{}, 1729954499000)
+	if !reflect.DeepEqual(delays, expected) {
+		t.Errorf("ScheduleLimits(%v, %v) = %v; want %v", []int{500, 500, 500, 500}, limits, delays, expected)
+	}
+
+	// Sub-second time frame, 1 call every 50 milliseconds
+	limits = []model.Limit{{RequestCount: 1, TimeFrameMs: 50}}
+
+	expected = []int{0, 50, 100, 150, 200}
+	delays, _, _ = ScheduleLimits(make([]int, 5), limits, []int64{}, []int{}, 1729954499000)
+	if !reflect.DeepEqual(delays, expected) {
+		t.Errorf("ScheduleLimits(5, %v) = %v; want %v", limits, delays, expected)
+	}
+}
+
+func TestSequentialLimitsScheduling(t *testing.T) {
+	// 3 calls per minute and 4 calls per hour
+	limits := []model.Limit{
+		{RequestCount: 3, TimeFrame: 60},
+		{RequestCount: 4, TimeFrame: 3600},
+	}
+	now := int64(0)
+
+	expectedFirst := []int{0, 0, 0}
+	delays, calls, tokens := ScheduleLimits(make([]int, 3), limits, []int64{}, []int{}, now)
+	if !reflect.DeepEqual(delays, expectedFirst) {
+		t.Errorf("First schedule call = %v; want %v", delays, expectedFirst)
+	}
+
+	// Wait for 2 minutes, the minute window is empty but the hour window only has one slot left
+	now += 120000
+
+	expectedSecond := []int{0, 3480000}
+	delays, _, _ = ScheduleLimits(make([]int, 2), limits, calls, tokens, now)
+	if !reflect.DeepEqual(delays, expectedSecond) {
+		t.Errorf("Second schedule call = %v; want %v", delays, expectedSecond)
+	}
+}
+
+func TestReleaseCall(t *testing.T) {
+	// 2 calls per minute
+	limits := []model.Limit{{RequestCount: 2, TimeFrame: 60}}
+
+	delays, calls, tokens := ScheduleLimits(make([]int, 3), limits, []int64{}, []int{}, 0)
+	if !reflect.DeepEqual(delays, []int{0, 0, 60000}) {
+		t.Errorf("First schedule call = %v; want %v", delays, []int{0, 0, 60000})
+	}
+
+	// Releasing one of the immediate calls frees a slot before the last scheduled call
+	calls, tokens, released := ReleaseCall(calls, tokens, 0, 0)
+	if !released || len(calls) != 2 || len(tokens) != 2 {
+		t.Errorf("ReleaseCall(0) = %v, %v, %t; want 2 calls left", calls, tokens, released)
+	}
+
+	// The freed slot is reused, the next call still waits for the window of the last scheduled call
+	delays, calls, tokens = ScheduleLimits(make([]int, 2), limits, calls, tokens, 1000)
+	if !reflect.DeepEqual(delays, []int{0, 60000}) {
+		t.Errorf("Schedule call after release = %v; want %v", delays, []int{0, 60000})
+	}
+	if !reflect.DeepEqual(calls, []int64{0, 1000, 60000, 61000}) {
+		t.Errorf("Scheduled calls after release = %v; want %v", calls, []int64{0, 1000, 60000, 61000})
+	}
+
+	// Unknown calls are not released
+	if _, _, released := ReleaseCall(calls, tokens, 42, 0); released {
+		t.Errorf("ReleaseCall(42) released a call that was never scheduled")
+	}
+}
+
+func TestScheduleLimitsLaterCalls(t *testing.T) {
+	// 2 calls per minute, with calls already scheduled in the future
+	limits := []model.Limit{{RequestCount: 2, TimeFrame: 60}}
+	previousCalls := []int64{50000, 70000}
+
+	// A call at 0 would be in the window of the call at 50000 only, a second one would overflow it
+	expected := []int{0, 110000}
+	delays, _, _ := ScheduleLimits(make([]int, 2), limits, previousCalls, nil, 0)
+	if !reflect.DeepEqual(delays, expected) {
+		t.Errorf("ScheduleLimits(2, %v) = %v; want %v", previousCalls, delays, expected)
+	}
+}
+
+func TestScheduleLevels(t *testing.T) {
+	now := int64(100000)
+	limits := []model.Limit{{RequestCount: 10, TimeFrame: 60}}
+	shareLimits := []model.Limit{{RequestCount: 5, TimeFrame: 60}}
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		numCalls       int
+		levels         []Level
+		expectedDelays []int
+	}{
+		{
+			name:     "Free capacity borrowed before the limits of a tenant apply",
+			numCalls: 8,
+			levels: []Level{
+				{Limits: limits},
+				{Limits: shareLimits, From: now + 60000},
+			},
+			expectedDelays: []int{0, 0, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:     "Limits of a tenant applied after the first window",
+			numCalls: 14,
+			levels: []Level{
+				{Limits: limits},
+				{Limits: shareLimits, From: now + 60000},
+			},
+			expectedDelays: []int{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 60000, 60000, 60000, 60000},
+		},
+		{
+			name:     "Calls of other tenants",
+			numCalls: 7,
+			levels: []Level{
+				{Limits: limits, Calls: []int64{now, now, now, now, now, now, now, now, now + 60000, now + 60000}},
+				{Limits: shareLimits, From: now + 60000},
+			},
+			expectedDelays: []int{0, 0, 60000, 60000, 60000, 60000, 60000},
+		},
+		{
+			name:     "Parent limit shared with another child",
+			numCalls: 5,
+			levels: []Level{
+				{Limits: limits},
+				{Limits: []model.Limit{{RequestCount: 12, TimeFrame: 60}}, Calls: []int64{now - 1000, now - 1000, now - 1000, now - 1000, now - 1000, now - 1000, now - 1000, now - 1000}},
+			},
+			expectedDelays: []int{0, 0, 0, 0, 59000},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			delays, levels := ScheduleLevels(make([]int, tc.numCalls), tc.levels, now)
+			if !reflect.DeepEqual(delays, tc.expectedDelays) {
+				t.Errorf("expected delays %v, got %v", tc.expectedDelays, delays)
+			}
+			for i, level := range levels {
+				if len(level.Calls) != len(tc.levels[i].Calls)+tc.numCalls {
+					t.Errorf("expected %d calls in level %d, got %d", len(tc.levels[i].Calls)+tc.numCalls, i, len(level.Calls))
+				}
+			}
+		})
+	}
+}
+
+func TestScheduleLevelsAfter(t *testing.T) {
+	now := int64(100000)
+	levels := []Level{{Limits: []model.Limit{{RequestCount: 2, TimeFrame: 60}}}}
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		earliest       []int64
+		expectedDelays []int
+	}{
+		{
+			name:           "No earliest time",
+			earliest:       nil,
+			expectedDelays: []int{0, 0, 60000},
+		},
+		{
+			name:           "Calls kept after their earliest time",
+			earliest:       []int64{now, now + 5000, now + 5000},
+			expectedDelays: []int{0, 5000, 60000},
+		},
+		{
+			name:           "Earliest time after the next free slot",
+			earliest:       []int64{now, now, now + 90000},
+			expectedDelays: []int{0, 0, 90000},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			delays, _ := ScheduleLevelsAfter(make([]int, 3), tc.earliest, levels, now)
+			if !reflect.DeepEqual(delays, tc.expectedDelays) {
+				t.Errorf("expected delays %v, got %v", tc.expectedDelays, delays)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package scheduler
+
+import (
+	"math"
+	"meter_flow/model"
+)
+
+// LimitStatus is the usage of a single limit at a given time
+type LimitStatus struct {
+	Used            int   // Calls within the window ending now
+	Remaining       int   // Calls that can still be made now without waiting
+	TokensUsed      int   // Tokens within the window ending now
+	TokensRemaining int   // Tokens that can still be used now, only set with a token count
+	NextFree        int64 // Earliest time at which one more call can be made
+}
+
+// Status is the usage of every limit of a resource at a given time
+type Status struct {
+	Limits   []LimitStatus
+	NextFree int64 // Earliest time at which one more call fits in every limit
+	QueueEnd int64 // Time of the last scheduled call, now if no call is scheduled later
+}
+
+// SlidingWindowStatus returns the usage of the sliding window limits at now, in milliseconds.
+// The calls scheduled later count against the remaining slots, since the windows that include them also include now.
+func SlidingWindowStatus(limits []model.Limit, calls []int64, tokens []int, now int64) Status {
+	windows := limitWindows(limits)
+	calls, tokens = filterRecentCalls(calls, tokens, now-longestWindow(windows))
+
+	status := Status{
+		NextFree: nextSlot(calls, tokens, windows, 0, now),
+		QueueEnd: now,
+	}
+	if len(calls) > 0 {
+		status.QueueEnd = max(now, calls[len(calls)-1])
+	}
+
+	for _, w := range windows {
+		limitStatus := LimitStatus{NextFree: nextSlot(calls, tokens, []window{w}, 0, now)}
+		first, end := windowBounds(calls, w.length, now)
+		limitStatus.Used = end - first
+		for i := first; i < end; i++ {
+			limitStatus.TokensUsed += tokens[i]
+		}
+
+		// The fullest window including now, among the ones ending now or at a later call
+		maxCalls, maxTokens := limitStatus.Used, limitStatus.TokensUsed
+		for j := end; j < len(calls) && calls[j] < now+w.length; j++ {
+			first, last := windowBounds(calls, w.length, calls[j])
+			used := 0
+			for i := first; i < last; i++ {
+				used += tokens[i]
+			}
+			maxCalls, maxTokens = max(maxCalls, last-first), max(maxTokens, used)
+		}
+
+		limitStatus.Remaining = max(0, w.requestCount-maxCalls)
+		if w.tokenCount > 0 {
+			limitStatus.TokensRemaining = max(0, w.tokenCount-maxTokens)
+		}
+		status.Limits = append(status.Limits, limitStatus)
+	}
+	return status
+}
+
+// TokenBucketStatus returns the usage of a token bucket at now, in milliseconds.
+// The refill rate is in tokens per second, and the tokens are negative when calls are queued.
+func TokenBucketStatus(capacity int, refillRate, tokens float64, lastUpdate, now int64) Status {
+	if now > lastUpdate {
+		tokens = math.Min(tokens+float64(now-lastUpdate)*refillRate/1000, float64(capacity))
+	}
+
+	limitStatus := LimitStatus{
+		Used:      capacity - int(math.Floor(math.Max(tokens, 0))),
+		Remaining: int(math.Floor(math.Max(tokens, 0))),
+		NextFree:  now,
+	}
+	if tokens < 1 {
+		limitStatus.NextFree = now + int64(math.Ceil((1-tokens)/refillRate*1000-epsilon))
+	}
+
+	status := Status{
+		Limits:   []LimitStatus{limitStatus},
+		NextFree: limitStatus.NextFree,
+		QueueEnd: now,
+	}
+	if tokens < 0 {
+		// The last queued call waits until the refill has paid back the whole deficit
+		status.QueueEnd = now + int64(math.Ceil(-tokens/refillRate*1000-epsilon))
+	}
+	return status
+}
@@ -0,0 +1,139 @@
+package scheduler
+
+import (
+	"meter_flow/model"
+	"reflect"
+	"testing"
+)
+
+func TestSlidingWindowStatus(t *testing.T) {
+	now := int64(100000)
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		limits         []model.Limit
+		calls          []int64
+		tokens         []int
+		expectedStatus Status
+	}{
+		{
+			name:   "No calls",
+			limits: []model.Limit{{RequestCount: 2, TimeFrame: 60}},
+			expectedStatus: Status{
+				Limits:   []LimitStatus{{Used: 0, Remaining: 2, NextFree: now}},
+				NextFree: now,
+				QueueEnd: now,
+			},
+		},
+		{
+			name:   "Old calls pruned",
+			limits: []model.Limit{{RequestCount: 2, TimeFrame: 60}},
+			calls:  []int64{now - 70000, now - 10000},
+			tokens: []int{0, 0},
+			expectedStatus: Status{
+				Limits:   []LimitStatus{{Used: 1, Remaining: 1, NextFree: now}},
+				NextFree: now,
+				QueueEnd: now,
+			},
+		},
+		{
+			name:   "Full window with a queue",
+			limits: []model.Limit{{RequestCount: 2, TimeFrame: 60}},
+			calls:  []int64{now - 10000, now, now + 50000},
+			tokens: []int{0, 0, 0},
+			expectedStatus: Status{
+				Limits:   []LimitStatus{{Used: 2, Remaining: 0, NextFree: now + 60000}},
+				NextFree: now + 60000,
+				QueueEnd: now + 50000,
+			},
+		},
+		{
+			name:   "Token limit",
+			limits: []model.Limit{{RequestCount: 10, TokenCount: 100, TimeFrame: 60}},
+			calls:  []int64{now - 10000},
+			tokens: []int{100},
+			expectedStatus: Status{
+				Limits:   []LimitStatus{{Used: 1, Remaining: 9, TokensUsed: 100, TokensRemaining: 0, NextFree: now}},
+				NextFree: now,
+				QueueEnd: now,
+			},
+		},
+		{
+			name:   "Stacked limits",
+			limits: []model.Limit{{RequestCount: 1, TimeFrame: 1}, {RequestCount: 3, TimeFrame: 60}},
+			calls:  []int64{now - 30000, now - 500},
+			tokens: []int{0, 0},
+			expectedStatus: Status{
+				Limits: []LimitStatus{
+					{Used: 1, Remaining: 0, NextFree: now + 500},
+					{Used: 2, Remaining: 1, NextFree: now},
+				},
+				NextFree: now + 500,
+				QueueEnd: now,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			status := SlidingWindowStatus(tc.limits, tc.calls, tc.tokens, now)
+			if !reflect.DeepEqual(status, tc.expectedStatus) {
+				t.Errorf("expected status %+v, got %+v", tc.expectedStatus, status)
+			}
+		})
+	}
+}
+
+func TestTokenBucketStatus(t *testing.T) {
+	now := int64(100000)
+
+	// Test cases
+	testCases := []struct {
+		name           string
+		tokens         float64
+		lastUpdate     int64
+		expectedStatus Status
+	}{
+		{
+			name:       "Full bucket",
+			tokens:     10,
+			lastUpdate: now,
+			expectedStatus: Status{
+				Limits:   []LimitStatus{{Used: 0, Remaining: 10, NextFree: now}},
+				NextFree: now,
+				QueueEnd: now,
+			},
+		},
+		{
+			name:       "Refilled bucket",
+			tokens:     0,
+			lastUpdate: now - 4000,
+			expectedStatus: Status{
+				Limits:   []LimitStatus{{Used: 8, Remaining: 2, NextFree: now}},
+				NextFree: now,
+				QueueEnd: now,
+			},
+		},
+		{
+			name:       "Queued calls",
+			tokens:     -3,
+			lastUpdate: now,
+			expectedStatus: Status{
+				Limits:   []LimitStatus{{Used: 10, Remaining: 0, NextFree: now + 8000}},
+				NextFree: now + 8000,
+				QueueEnd: now + 6000,
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// A bucket of 10 tokens refilled at 0.5 tokens per second
+			status := TokenBucketStatus(10, 0.5, tc.tokens, tc.lastUpdate, now)
+			if !reflect.DeepEqual(status, tc.expectedStatus) {
+				t.Errorf("expected status %+v, got %+v", tc.expectedStatus, status)
+			}
+		})
+	}
+}
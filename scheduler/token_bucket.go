@@ -0,0 +1,47 @@
+package scheduler
+
+import "math"
+
+// epsilon absorbs floating point noise when converting a token deficit into a delay
+const epsilon = 1e-9
+
+// ScheduleTokenBucket schedules a set of new requests based on a token bucket rate limiting algorithm.
+// Each call consumes one token. When the bucket is empty the calls are queued by letting the token
+// count go negative, each call waiting until the refill has paid back its deficit.
+//
+// Parameters:
+//
+// numCalls (int): The number of new requests to schedule.
+// capacity (int): The maximum number of tokens the bucket can hold (burst size).
+// refillRate (float64): The number of tokens added to the bucket per second.
+// tokens (float64): The number of tokens in the bucket at lastUpdate (negative if calls are queued).
+// lastUpdate (int64): The Unix timestamp (in milliseconds) of the last bucket update.
+// now (int64): The current Unix timestamp (in milliseconds).
+//
+// Returns:
+//
+// delays ([]int): A slice of delays (in milliseconds) for each new request.
+// tokens (float64): The updated number of tokens in the bucket at now.
+func ScheduleTokenBucket(numCalls, capacity int, refillRate, tokens float64, lastUpdate, now int64) ([]int, float64) {
+	var delays []int
+
+	// Refill the bucket for the time elapsed since the last update
+	if now > lastUpdate {
+		tokens = math.Min(tokens+float64(now-lastUpdate)*refillRate/1000, float64(capacity))
+	}
+
+	// Schedule new calls
+	for i := 0; i < numCalls; i++ {
+		tokens--
+		if tokens >= 0 {
+			// No delay if a token is available
+			delays = append(delays, 0)
+		} else {
+			// Wait until the refill covers the deficit
+			delay := int(math.Ceil(-tokens/refillRate*1000 - epsilon))
+			delays = append(delays, delay)
+		}
+	}
+
+	return delays, tokens
+}
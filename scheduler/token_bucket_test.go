@@ -0,0 +1,78 @@
+package scheduler
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScheduleTokenBucket(t *testing.T) {
+	tests := []struct {
+		numCalls   int
+		capacity   int
+		refillRate float64
+		expected   []int
+	}{
+		{
+			numCalls:   5,
+			capacity:   2,
+			refillRate: 1,
+			expected:   []int{0, 0, 1000, 2000, 3000},
+		},
+		{
+			numCalls:   4,
+			capacity:   1,
+			refillRate: 0.5,
+			expected:   []int{0, 2000, 4000, 6000},
+		},
+		{
+			numCalls:   6,
+			capacity:   3,
+			refillRate: 10,
+			expected:   []int{0, 0, 0, 100, 200, 300},
+		},
+	}
+
+	for _, tt := range tests {
+		delays, _ := ScheduleTokenBucket(tt.numCalls, tt.capacity, tt.refillRate, float64(tt.capacity), 1729954499000, 1729954499000)
+		if !reflect.DeepEqual(delays, tt.expected) {
+			t.Errorf("ScheduleTokenBucket(%d, %d, %g) = %v; want %v", tt.numCalls, tt.capacity, tt.refillRate, delays, tt.expected)
+		}
+	}
+}
+
+func TestSequentialTokenBucket(t *testing.T) {
+	// Bucket of 3 tokens refilled at 1 token every 10 seconds
+	capacity := 3
+	refillRate := 0.1
+	tokens := float64(capacity)
+	lastUpdate := int64(0)
+	now := int64(0)
+
+	// First scheduling call drains the bucket
+	expectedFirst := []int{0, 0, 0, 10000}
+	delays, tokens := ScheduleTokenBucket(4, capacity, refillRate, tokens, lastUpdate, now)
+	if !reflect.DeepEqual(delays, expectedFirst) {
+		t.Errorf("First schedule call = %v; want %v", delays, expectedFirst)
+	}
+	lastUpdate = now
+
+	// Wait for 15 seconds, the queued call has been paid back and half a token is available
+	now += 15000
+
+	// Second scheduling call
+	expectedSecond := []int{5000, 15000}
+	delays, tokens = ScheduleTokenBucket(2, capacity, refillRate, tokens, lastUpdate, now)
+	if !reflect.DeepEqual(delays, expectedSecond) {
+		t.Errorf("Second schedule call = %v; want %v", delays, expectedSecond)
+	}
+	lastUpdate = now
+
+	// Wait long enough for the bucket to be full again, the refill is capped by the capacity
+	now += 1000000
+
+	expectedThird := []int{0, 0, 0, 10000}
+	delays, _ = ScheduleTokenBucket(4, capacity, refillRate, tokens, lastUpdate, now)
+	if !reflect.DeepEqual(delays, expectedThird) {
+		t.Errorf("Third schedule call = %v; want %v", delays, expectedThird)
+	}
+}
@@ -1,32 +1,205 @@
 package server
 
 import (
+	"fmt"
+	"log"
+	"maps"
 	"sync"
 
 	"meter_flow/model"
 	"meter_flow/storage"
 )
 
+// Number of times a change is applied again when other servers keep changing the resource
+const maxUpdateAttempts = 10
+
 type Server struct {
 	ResourceMutexes sync.Map // Map of resource name to resource-specific mutex
 	Resources       map[string]model.Resource
+	resourcesMutex  sync.RWMutex // Guards the Resources map itself, the resource-specific mutexes guard each resource
+	persistMutex    sync.Mutex   // Saves are made one at a time, so that an older snapshot never overwrites a newer one
 	storage         storage.Storage
+	shared          storage.SharedState // Set when the resources are shared with other servers, the Resources map is then unused
 }
 
-func NewServer(storage storage.Storage) *Server {
+func NewServer(store storage.Storage) *Server {
+	srv := &Server{
+		storage: store,
+	}
+	srv.shared, _ = store.(storage.SharedState)
+	if srv.shared != nil {
+		srv.Resources = make(map[string]model.Resource)
+		return srv
+	}
+
 	// Load initial state
-	resources, err := storage.Load()
+	resources, err := store.Load()
 	if err != nil {
 		println("Error loading resources:", err)
 		resources = make(map[string]model.Resource)
 	}
+	srv.Resources = resources
+	return srv
+}
+
+// Resource returns the resource with the given name
+func (s *Server) Resource(name string) (model.Resource, bool, error) {
+	if s.shared != nil {
+		resource, _, exists, err := s.shared.LoadResource(name)
+		return resource, exists, err
+	}
+
+	s.resourcesMutex.RLock()
+	defer s.resourcesMutex.RUnlock()
+	resource, exists := s.Resources[name]
+	return resource, exists, nil
+}
+
+// SetResource adds or replaces a resource. The storage errors are only returned when the resources are shared,
+// otherwise the resource is kept in memory and the error is logged.
+func (s *Server) SetResource(resource model.Resource) error {
+	if s.shared != nil {
+		return s.shared.Record(resource)
+	}
+
+	s.resourcesMutex.Lock()
+	s.Resources[resource.Name] = resource
+	s.resourcesMutex.Unlock()
+
+	s.record(resource)
+	return nil
+}
+
+// record appends a change of a resource to the storage, if it records every change. The caller holds the
+// resource-specific mutex, so the changes of a resource are recorded in order.
+func (s *Server) record(resource model.Resource) {
+	if recorder, ok := s.storage.(storage.Recorder); ok {
+		if err := recorder.Record(resource); err != nil {
+			log.Printf("Error recording resource %s: %v", resource.Name, err)
+		}
+	}
+}
+
+// UpdateResource applies a change to the resource with the given name and saves it, unless the change returns false.
+// It returns false if the resource doesn't exist. When the resources are shared, the change is applied to the latest
+// version of the resource, and applied again if another server changed the resource before it was saved.
+func (s *Server) UpdateResource(name string, change func(resource *model.Resource) bool) (bool, error) {
+	return s.UpdateResources([]string{name}, func(resources []*model.Resource) bool {
+		return change(resources[0])
+	})
+}
+
+// UpdateResources applies a change to several resources and saves them together, like UpdateResource.
+// It returns false if one of them doesn't exist. The caller must hold the mutex of every resource.
+func (s *Server) UpdateResources(names []string, change func(resources []*model.Resource) bool) (bool, error) {
+	if s.shared == nil {
+		resources := make([]*model.Resource, len(names))
+		for i, name := range names {
+			resource, exists, _ := s.Resource(name)
+			if !exists {
+				return false, nil
+			}
+			resources[i] = &resource
+		}
+		if change(resources) {
+			for _, resource := range resources {
+				s.SetResource(*resource)
+			}
+		}
+		return true, nil
+	}
+
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		resources := make([]*model.Resource, len(names))
+		loaded := make([]model.Resource, len(names))
+		versions := make([]int64, len(names))
+		for i, name := range names {
+			resource, version, exists, err := s.shared.LoadResource(name)
+			if err != nil || !exists {
+				return exists, err
+			}
+			// The change replaces the slices and maps of the resource rather than modifying them, the loaded copy stays intact
+			resources[i], loaded[i], versions[i] = &resource, resource, version
+		}
+		if !change(resources) {
+			return true, nil
+		}
 
-	return &Server{
-		Resources: resources,
-		storage:   storage,
+		updated := make([]model.Resource, len(resources))
+		for i, resource := range resources {
+			updated[i] = *resource
+		}
+		saved, err := s.shared.SaveResources(loaded, updated, versions)
+		if err != nil || saved {
+			return true, err
+		}
 	}
+	return true, fmt.Errorf("resources %v kept changing on other servers", names)
+}
+
+// AddResource adds a resource, unless a resource with the same name already exists. It returns false in that case.
+// When the resources are shared, a resource registered meanwhile by another server is never replaced.
+func (s *Server) AddResource(resource model.Resource) (bool, error) {
+	if s.shared != nil {
+		return s.shared.RecordNew(resource)
+	}
+
+	s.resourcesMutex.Lock()
+	if _, exists := s.Resources[resource.Name]; exists {
+		s.resourcesMutex.Unlock()
+		return false, nil
+	}
+	s.Resources[resource.Name] = resource
+	s.resourcesMutex.Unlock()
+
+	s.record(resource)
+	return true, nil
+}
+
+// RemoveResource deletes the resource with the given name. As with SetResource, the storage errors are
+// only returned when the resources are shared.
+func (s *Server) RemoveResource(name string) error {
+	if s.shared != nil {
+		return s.shared.RecordDelete(name)
+	}
+
+	s.resourcesMutex.Lock()
+	delete(s.Resources, name)
+	s.resourcesMutex.Unlock()
+
+	if recorder, ok := s.storage.(storage.Recorder); ok {
+		if err := recorder.RecordDelete(name); err != nil {
+			log.Printf("Error recording the deletion of resource %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// RecordsChanges reports whether the storage records each change as it happens, so no full save is needed after a change
+func (s *Server) RecordsChanges() bool {
+	_, ok := s.storage.(storage.Recorder)
+	return ok
+}
+
+// Snapshot returns a copy of the resources map. The resources themselves are shared: their slices
+// and maps are never modified in place, they are replaced when the resource changes.
+func (s *Server) Snapshot() (map[string]model.Resource, error) {
+	if s.shared != nil {
+		return s.storage.Load()
+	}
+
+	s.resourcesMutex.RLock()
+	defer s.resourcesMutex.RUnlock()
+	return maps.Clone(s.Resources), nil
 }
 
 func (s *Server) Persist() error {
-	return s.storage.Save(s.Resources)
+	s.persistMutex.Lock()
+	defer s.persistMutex.Unlock()
+
+	snapshot, err := s.Snapshot()
+	if err != nil {
+		return err
+	}
+	return s.storage.Save(snapshot)
 }
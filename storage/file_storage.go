@@ -4,10 +4,15 @@ import (
 	"encoding/json"
 	"meter_flow/model"
 	"os"
+	"path/filepath"
+	"time"
 )
 
 type FileStorage struct {
 	filepath string
+
+	// Also save the calls still within their window, so that the limits hold across restarts
+	PersistScheduledCalls bool
 }
 
 func NewFileStorage(filepath string) *FileStorage {
@@ -15,22 +20,48 @@ func NewFileStorage(filepath string) *FileStorage {
 }
 
 func (fs *FileStorage) Save(resources map[string]model.Resource) error {
-	// Create a DTO map without ScheduledCalls
+	// Create a DTO map, without ScheduledCalls unless they are persisted
 	persistentData := make(map[string]ResourceDTO)
 
 	for key, resource := range resources {
-		persistentData[key] = ResourceDTO{
-			Name:         resource.Name,
-			RequestCount: resource.RequestCount,
-			TimeFrame:    resource.TimeFrame,
+		dto := toDTO(resource)
+		if !fs.PersistScheduledCalls {
+			dto = dto.withoutState()
 		}
+		persistentData[key] = dto
 	}
 
 	data, err := json.Marshal(persistentData)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(fs.filepath, data, 0644)
+	return writeFileAtomic(fs.filepath, data)
+}
+
+// writeFileAtomic writes the data to a temporary file and renames it over the target,
+// so that a crash in the middle of the write never leaves a truncated file behind.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
 }
 
 func (fs *FileStorage) Load() (map[string]model.Resource, error) {
@@ -49,13 +80,12 @@ func (fs *FileStorage) Load() (map[string]model.Resource, error) {
 
 	// Convert back to full Resource objects
 	resources := make(map[string]model.Resource)
+	now := time.Now().UnixMilli()
 	for key, dto := range persistentData {
-		resources[key] = model.Resource{
-			Name:           dto.Name,
-			RequestCount:   dto.RequestCount,
-			TimeFrame:      dto.TimeFrame,
-			ScheduledCalls: []int64{}, // Empty slice for scheduled calls
+		if !fs.PersistScheduledCalls {
+			dto = dto.withoutState()
 		}
+		resources[key] = fromDTO(dto, now)
 	}
 
 	return resources, nil
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"meter_flow/model"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFileStoragePersistScheduledCalls(t *testing.T) {
+	now := time.Now().UnixMilli()
+
+	// A resource limited to 10 requests per minute, with one call that already left the window
+	resources := map[string]model.Resource{
+		"test_resource": {
+			Name:            "test_resource",
+			Algorithm:       model.AlgorithmSlidingWindow,
+			RequestCount:    10,
+			TimeFrame:       60,
+			ScheduledCalls:  []int64{now - 120000, now - 1000, now + 5000},
+			ScheduledTokens: []int{1, 2, 3},
+			Reservations: map[string]model.Reservation{
+				"old": {Timestamp: now - 120000, Weight: 1},
+				"new": {Timestamp: now + 5000, Weight: 3},
+			},
+		},
+	}
+
+	// Test cases
+	testCases := []struct {
+		name                 string
+		persist              bool
+		expectedCalls        []int64
+		expectedTokens       []int
+		expectedReservations []string
+	}{
+		{
+			name:                 "Scheduled calls persisted",
+			persist:              true,
+			expectedCalls:        []int64{now - 1000, now + 5000},
+			expectedTokens:       []int{2, 3},
+			expectedReservations: []string{"new"},
+		},
+		{
+			name:           "Scheduled calls not persisted",
+			persist:        false,
+			expectedCalls:  []int64{},
+			expectedTokens: []int{},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			storage := NewFileStorage(filepath.Join(t.TempDir(), "resources.json"))
+			storage.PersistScheduledCalls = tc.persist
+
+			if err := storage.Save(resources); err != nil {
+				t.Errorf("failed to save resources: %v", err)
+			}
+			loaded, err := storage.Load()
+			if err != nil {
+				t.Errorf("failed to load resources: %v", err)
+			}
+
+			resource := loaded["test_resource"]
+			if resource.RequestCount != 10 || resource.TimeFrame != 60 {
+				t.Errorf("expected a limit of 10 requests per 60 seconds, got %d per %d", resource.RequestCount, resource.TimeFrame)
+			}
+			if !reflect.DeepEqual(resource.ScheduledCalls, tc.expectedCalls) {
+				t.Errorf("expected scheduled calls %v, got %v", tc.expectedCalls, resource.ScheduledCalls)
+			}
+			if !reflect.DeepEqual(resource.ScheduledTokens, tc.expectedTokens) {
+				t.Errorf("expected scheduled tokens %v, got %v", tc.expectedTokens, resource.ScheduledTokens)
+			}
+			if len(resource.Reservations) != len(tc.expectedReservations) {
+				t.Errorf("expected %d reservations, got %d", len(tc.expectedReservations), len(resource.Reservations))
+			}
+			for _, id := range tc.expectedReservations {
+				if _, exists := resource.Reservations[id]; !exists {
+					t.Errorf("expected reservation %s to be loaded", id)
+				}
+			}
+		})
+	}
+}
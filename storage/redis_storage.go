@@ -0,0 +1,513 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"meter_flow/model"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// recordScript saves a whole resource, replacing its scheduled calls and reservations, if its version is still the
+// expected one. A negative expected version saves it in any case, and 0 only if it doesn't exist yet.
+//
+// KEYS[1]: set of the resource names
+// KEYS[2], KEYS[3], KEYS[4]: hash of the resource with its version and data, sorted set of its calls, hash of its reservations
+// ARGV[1], ARGV[2], ARGV[3]: expected version, name and data of the resource
+// ARGV[4], ARGV[5]: JSON arrays of the scores and members of the calls, and of the IDs and values of the reservations
+var recordScript = redis.NewScript(`
+local version = tonumber(redis.call('HGET', KEYS[2], 'version') or '0')
+local expected = tonumber(ARGV[1])
+if expected >= 0 and version ~= expected then
+	return 0
+end
+redis.call('HSET', KEYS[2], 'version', version + 1, 'data', ARGV[3])
+redis.call('DEL', KEYS[3], KEYS[4])
+local calls = cjson.decode(ARGV[4])
+for i = 1, #calls, 2 do
+	redis.call('ZADD', KEYS[3], calls[i], calls[i + 1])
+end
+local reservations = cjson.decode(ARGV[5])
+for i = 1, #reservations, 2 do
+	redis.call('HSET', KEYS[4], reservations[i], reservations[i + 1])
+end
+redis.call('SADD', KEYS[1], ARGV[2])
+return 1
+`)
+
+// saveScript saves the changes of resources together. The data of each resource is only saved if its version is still
+// the expected one, a negative expected version saves it in any case. The calls and reservations are saved as the
+// ones added and removed, so that the calls other servers scheduled meanwhile are kept: the changes only conflict
+// with them if a window of the limits holding an added call no longer fits the limits. It runs atomically, so two
+// servers scheduling calls on the same resource never overshoot its limits.
+//
+// KEYS[1]: set of the resource names
+// KEYS[3i-1], KEYS[3i], KEYS[3i+1]: hash, sorted set of the calls and hash of the reservations of the i-th resource
+// ARGV[i]: changes of the i-th resource, in JSON (see resourceChanges)
+var saveScript = redis.NewScript(`
+local changes = {}
+for i = 1, #ARGV do
+	changes[i] = cjson.decode(ARGV[i])
+end
+
+-- fits reports whether every window of the limits holding an added call fits the limits, with the latest calls
+local function fits(key, change)
+	local members = redis.call('ZRANGEBYSCORE', key, change.from, change.to, 'WITHSCORES')
+	local calls = {}
+	for j = 1, #members, 2 do
+		calls[#calls + 1] = {at = tonumber(members[j + 1]), weight = tonumber(string.match(members[j], '^(%d+):')), added = 0}
+	end
+	for _, removed in ipairs(change.removed) do
+		local at, weight = tonumber(removed[1]), tonumber(removed[2])
+		for j, call in ipairs(calls) do
+			if call.at == at and call.weight == weight then
+				table.remove(calls, j)
+				break
+			end
+		end
+	end
+	for _, added in ipairs(change.added) do
+		calls[#calls + 1] = {at = tonumber(added[1]), weight = tonumber(added[2]), added = 1}
+	end
+	table.sort(calls, function(a, b) return a.at < b.at end)
+
+	for _, limit in ipairs(change.limits) do
+		local requestCount, tokenCount, length = limit[1], limit[2], limit[3]
+		local first, tokens, added = 1, 0, 0
+		for j, call in ipairs(calls) do
+			tokens, added = tokens + call.weight, added + call.added
+			while calls[first].at <= call.at - length do
+				tokens, added = tokens - calls[first].weight, added - calls[first].added
+				first = first + 1
+			end
+			-- The window ending at a call holds every call made at the same time
+			local last = j == #calls or calls[j + 1].at ~= call.at
+			if last and added > 0 and (j - first + 1 > requestCount or (tokenCount > 0 and tokens > tokenCount)) then
+				return false
+			end
+		end
+	end
+	return true
+end
+
+local versions = {}
+for i, change in ipairs(changes) do
+	local version = tonumber(redis.call('HGET', KEYS[3 * i - 1], 'version') or '0')
+	if change.version >= 0 and version ~= change.version then
+		return 0
+	end
+	if #change.limits > 0 and not fits(KEYS[3 * i], change) then
+		return 0
+	end
+	versions[i] = version
+end
+
+for i, change in ipairs(changes) do
+	local hash, calls, reservations = KEYS[3 * i - 1], KEYS[3 * i], KEYS[3 * i + 1]
+	if change.data ~= '' then
+		redis.call('HSET', hash, 'version', versions[i] + 1, 'data', change.data)
+		redis.call('SADD', KEYS[1], change.name)
+	end
+
+	redis.call('ZREMRANGEBYSCORE', calls, '-inf', change.prune)
+	for _, removed in ipairs(change.removed) do
+		for _, member in ipairs(redis.call('ZRANGEBYSCORE', calls, removed[1], removed[1])) do
+			if string.match(member, '^(%d+):') == removed[2] then
+				redis.call('ZREM', calls, member)
+				break
+			end
+		end
+	end
+	for _, added in ipairs(change.added) do
+		redis.call('ZADD', calls, added[1], added[3])
+	end
+
+	for _, id in ipairs(change.unreserved) do
+		redis.call('HDEL', reservations, id)
+	end
+	for id, reservation in pairs(change.reserved) do
+		redis.call('HSET', reservations, id, reservation)
+	end
+end
+return 1
+`)
+
+// RedisStorage keeps every resource, with its scheduled calls, in Redis so that several servers share them.
+// The settings of a resource are kept with its version in a hash, its calls in a sorted set by time (each member
+// holding the weight of its call), and its reservations in another hash.
+type RedisStorage struct {
+	client redis.UniversalClient
+	prefix string
+}
+
+func NewRedisStorage(client redis.UniversalClient) *RedisStorage {
+	return &RedisStorage{
+		client: client,
+		prefix: "meterflow:",
+	}
+}
+
+// resourceChanges are the changes of a resource saved by saveScript. The times and weights of the calls are
+// strings, so that Lua keeps every digit of the times.
+type resourceChanges struct {
+	Version    int64             `json:"version"`    // Expected version of the resource, negative for any
+	Name       string            `json:"name"`       // Name of the resource, added to the set of the names with its data
+	Data       string            `json:"data"`       // New data of the resource, empty if unchanged
+	Removed    [][]string        `json:"removed"`    // Time and weight of each removed call
+	Added      [][]string        `json:"added"`      // Time, weight and member of each added call
+	Limits     [][]int64         `json:"limits"`     // Request count, token count and time frame of the limits the added calls must fit, if checked
+	From       string            `json:"from"`       // Exclusive start of the windows holding an added call
+	To         string            `json:"to"`         // Exclusive end of the windows holding an added call
+	Prune      string            `json:"prune"`      // Time up to which the calls left every window
+	Unreserved []string          `json:"unreserved"` // IDs of the removed reservations
+	Reserved   map[string]string `json:"reserved"`   // New or moved reservations
+}
+
+// scheduledCall is a call of a resource, with its weight
+type scheduledCall struct {
+	at     int64
+	weight int
+}
+
+// Save does nothing, every change is already saved as it happens
+func (rs *RedisStorage) Save(resources map[string]model.Resource) error {
+	return nil
+}
+
+// Load returns every resource stored in Redis
+func (rs *RedisStorage) Load() (map[string]model.Resource, error) {
+	ctx := context.Background()
+	names, err := rs.client.SMembers(ctx, rs.namesKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	reads := make([]resourceReads, len(names))
+	_, err = rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, name := range names {
+			reads[i] = rs.queueReads(ctx, pipe, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixMilli()
+	resources := make(map[string]model.Resource, len(names))
+	for _, read := range reads {
+		resource, _, exists, err := read.resource(now)
+		if err != nil {
+			return nil, err
+		}
+		// A resource deleted since the names were read doesn't exist
+		if exists {
+			resources[resource.Name] = resource
+		}
+	}
+	return resources, nil
+}
+
+// LoadResource returns the latest version of a resource
+func (rs *RedisStorage) LoadResource(name string) (model.Resource, int64, bool, error) {
+	ctx := context.Background()
+	var read resourceReads
+	_, err := rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		read = rs.queueReads(ctx, pipe, name)
+		return nil
+	})
+	if err != nil {
+		return model.Resource{}, 0, false, err
+	}
+	return read.resource(time.Now().UnixMilli())
+}
+
+// SaveResources saves the changes made to resources loaded at the given versions, it returns false if they
+// conflict with the changes of other servers
+func (rs *RedisStorage) SaveResources(loaded, changed []model.Resource, versions []int64) (bool, error) {
+	now := time.Now().UnixMilli()
+	keys := []string{rs.namesKey()}
+	args := make([]interface{}, len(changed))
+	for i, resource := range changed {
+		changes, err := resourceChangesOf(loaded[i], resource, versions[i], now)
+		if err != nil {
+			return false, err
+		}
+		encoded, err := json.Marshal(changes)
+		if err != nil {
+			return false, err
+		}
+		keys = append(keys, rs.resourceKey(resource.Name), rs.callsKey(resource.Name), rs.reservationsKey(resource.Name))
+		args[i] = encoded
+	}
+
+	saved, err := saveScript.Run(context.Background(), rs.client, keys, args...).Int()
+	if err != nil {
+		return false, err
+	}
+	return saved == 1, nil
+}
+
+// Record saves a resource whatever its version
+func (rs *RedisStorage) Record(resource model.Resource) error {
+	_, err := rs.record(resource, -1)
+	return err
+}
+
+// RecordNew saves a new resource, it returns false if the resource already exists
+func (rs *RedisStorage) RecordNew(resource model.Resource) (bool, error) {
+	return rs.record(resource, 0)
+}
+
+// RecordDelete removes a resource
+func (rs *RedisStorage) RecordDelete(name string) error {
+	ctx := context.Background()
+	_, err := rs.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, rs.resourceKey(name), rs.callsKey(name), rs.reservationsKey(name))
+		pipe.SRem(ctx, rs.namesKey(), name)
+		return nil
+	})
+	return err
+}
+
+func (rs *RedisStorage) record(resource model.Resource, version int64) (bool, error) {
+	data, err := json.Marshal(toDTO(resource).withoutCalls())
+	if err != nil {
+		return false, err
+	}
+	calls := make([]string, 0, 2*len(resource.ScheduledCalls))
+	for i, at := range resource.ScheduledCalls {
+		calls = append(calls, strconv.FormatInt(at, 10), callMember(callWeight(resource.ScheduledTokens, i)))
+	}
+	reservations := make([]string, 0, 2*len(resource.Reservations))
+	for id, reservation := range resource.Reservations {
+		value, err := json.Marshal(reservation)
+		if err != nil {
+			return false, err
+		}
+		reservations = append(reservations, id, string(value))
+	}
+	encodedCalls, err := json.Marshal(calls)
+	if err != nil {
+		return false, err
+	}
+	encodedReservations, err := json.Marshal(reservations)
+	if err != nil {
+		return false, err
+	}
+
+	keys := []string{rs.namesKey(), rs.resourceKey(resource.Name), rs.callsKey(resource.Name), rs.reservationsKey(resource.Name)}
+	saved, err := recordScript.Run(context.Background(), rs.client, keys, version, resource.Name, data, encodedCalls, encodedReservations).Int()
+	if err != nil {
+		return false, err
+	}
+	return saved == 1, nil
+}
+
+// resourceReads are the queued reads of a resource: its version and data, its calls and its reservations
+type resourceReads struct {
+	hash         *redis.SliceCmd
+	calls        *redis.ZSliceCmd
+	reservations *redis.MapStringStringCmd
+}
+
+func (rs *RedisStorage) queueReads(ctx context.Context, pipe redis.Pipeliner, name string) resourceReads {
+	return resourceReads{
+		hash:         pipe.HMGet(ctx, rs.resourceKey(name), "version", "data"),
+		calls:        pipe.ZRangeWithScores(ctx, rs.callsKey(name), 0, -1),
+		reservations: pipe.HGetAll(ctx, rs.reservationsKey(name)),
+	}
+}
+
+// resource returns the resource read and its version
+func (read resourceReads) resource(now int64) (model.Resource, int64, bool, error) {
+	values := read.hash.Val()
+	if values[0] == nil || values[1] == nil {
+		return model.Resource{}, 0, false, nil
+	}
+	version, err := strconv.ParseInt(values[0].(string), 10, 64)
+	if err != nil {
+		return model.Resource{}, 0, false, err
+	}
+	var dto ResourceDTO
+	if err := json.Unmarshal([]byte(values[1].(string)), &dto); err != nil {
+		return model.Resource{}, 0, false, err
+	}
+
+	// The calls are sorted by time
+	for _, call := range read.calls.Val() {
+		weight, err := memberWeight(call.Member.(string))
+		if err != nil {
+			return model.Resource{}, 0, false, err
+		}
+		dto.ScheduledCalls = append(dto.ScheduledCalls, int64(call.Score))
+		dto.ScheduledTokens = append(dto.ScheduledTokens, weight)
+	}
+	dto.Reservations = make(map[string]model.Reservation, len(read.reservations.Val()))
+	for id, value := range read.reservations.Val() {
+		var reservation model.Reservation
+		if err := json.Unmarshal([]byte(value), &reservation); err != nil {
+			return model.Resource{}, 0, false, err
+		}
+		dto.Reservations[id] = reservation
+	}
+	return fromDTO(dto, now), version, true, nil
+}
+
+// resourceChangesOf returns the changes made to a resource loaded at the given version
+func resourceChangesOf(loaded, changed model.Resource, version, now int64) (resourceChanges, error) {
+	changes := resourceChanges{
+		Version:    version,
+		Name:       changed.Name,
+		Removed:    [][]string{},
+		Added:      [][]string{},
+		Limits:     [][]int64{},
+		Prune:      strconv.FormatInt(now-changed.LongestTimeFrameMillis(), 10),
+		Unreserved: []string{},
+		Reserved:   make(map[string]string),
+	}
+
+	// The data is only saved if it changed, so that the calls scheduled by other servers don't conflict
+	loadedData, err := json.Marshal(toDTO(loaded).withoutCalls())
+	if err != nil {
+		return resourceChanges{}, err
+	}
+	changedData, err := json.Marshal(toDTO(changed).withoutCalls())
+	if err != nil {
+		return resourceChanges{}, err
+	}
+	if string(changedData) != string(loadedData) {
+		changes.Data = string(changedData)
+	}
+
+	// The calls found in both are unchanged, the others were added or removed
+	counts := make(map[scheduledCall]int)
+	for i, at := range loaded.ScheduledCalls {
+		counts[scheduledCall{at: at, weight: callWeight(loaded.ScheduledTokens, i)}]++
+	}
+	added := make([]bool, len(changed.ScheduledCalls))
+	first, last := int64(0), int64(0)
+	for i, at := range changed.ScheduledCalls {
+		call := scheduledCall{at: at, weight: callWeight(changed.ScheduledTokens, i)}
+		if counts[call] > 0 {
+			counts[call]--
+			continue
+		}
+		if len(changes.Added) == 0 {
+			first = at
+		}
+		first, last = min(first, at), max(last, at)
+		added[i] = true
+		changes.Added = append(changes.Added, []string{strconv.FormatInt(at, 10), strconv.Itoa(call.weight), callMember(call.weight)})
+	}
+	prune := now - changed.LongestTimeFrameMillis()
+	for call, count := range counts {
+		// The calls that left every window are pruned anyway
+		for range count {
+			if call.at > prune {
+				changes.Removed = append(changes.Removed, []string{strconv.FormatInt(call.at, 10), strconv.Itoa(call.weight)})
+			}
+		}
+	}
+
+	// The added calls are checked against the calls other servers scheduled meanwhile, unless they already went
+	// beyond the limits, for instance with calls counted after the API reported them
+	if len(changes.Added) > 0 && changed.Algorithm != model.AlgorithmTokenBucket {
+		limits := changed.SlidingWindowLimits()
+		if addedCallsFit(changed.ScheduledCalls, changed.ScheduledTokens, added, limits) {
+			longest := changed.LongestTimeFrameMillis()
+			for _, limit := range limits {
+				changes.Limits = append(changes.Limits, []int64{int64(limit.RequestCount), int64(limit.TokenCount), limit.TimeFrameMillis()})
+			}
+			changes.From = "(" + strconv.FormatInt(first-longest, 10)
+			changes.To = "(" + strconv.FormatInt(last+longest, 10)
+		}
+	}
+
+	// The reservations are replaced when moved
+	for id, reservation := range changed.Reservations {
+		if previous, exists := loaded.Reservations[id]; exists && previous == reservation {
+			continue
+		}
+		value, err := json.Marshal(reservation)
+		if err != nil {
+			return resourceChanges{}, err
+		}
+		changes.Reserved[id] = string(value)
+	}
+	for id := range loaded.Reservations {
+		if _, exists := changed.Reservations[id]; !exists {
+			changes.Unreserved = append(changes.Unreserved, id)
+		}
+	}
+	return changes, nil
+}
+
+// addedCallsFit reports whether every window of the limits holding an added call fits the limits, like saveScript
+func addedCallsFit(calls []int64, tokens []int, added []bool, limits []model.Limit) bool {
+	for _, limit := range limits {
+		length := limit.TimeFrameMillis()
+		first, used, addedCalls := 0, 0, 0
+		for j, at := range calls {
+			used += callWeight(tokens, j)
+			if added[j] {
+				addedCalls++
+			}
+			for calls[first] <= at-length {
+				used -= callWeight(tokens, first)
+				if added[first] {
+					addedCalls--
+				}
+				first++
+			}
+			// The window ending at a call holds every call made at the same time
+			last := j == len(calls)-1 || calls[j+1] != at
+			if last && addedCalls > 0 && (j-first+1 > limit.RequestCount || (limit.TokenCount > 0 && used > limit.TokenCount)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// callWeight returns the weight of the i-th call, missing weights count as 0
+func callWeight(tokens []int, i int) int {
+	if i < len(tokens) {
+		return tokens[i]
+	}
+	return 0
+}
+
+// callMember returns a new member of the sorted set of the calls, for a call of the given weight
+func callMember(weight int) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return strconv.Itoa(weight) + ":" + hex.EncodeToString(b)
+}
+
+// memberWeight returns the weight of the call of a member of the sorted set of the calls
+func memberWeight(member string) (int, error) {
+	weight, _, _ := strings.Cut(member, ":")
+	return strconv.Atoi(weight)
+}
+
+func (rs *RedisStorage) resourceKey(name string) string {
+	return rs.prefix + "resource:" + name
+}
+
+func (rs *RedisStorage) callsKey(name string) string {
+	return rs.prefix + "calls:" + name
+}
+
+func (rs *RedisStorage) reservationsKey(name string) string {
+	return rs.prefix + "reservations:" + name
+}
+
+func (rs *RedisStorage) namesKey() string {
+	return rs.prefix + "resources"
+}
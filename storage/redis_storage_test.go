@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"meter_flow/model"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedisStorage returns a storage backed by an in-process Redis
+func newTestRedisStorage(t *testing.T) *RedisStorage {
+	redisServer := miniredis.RunT(t)
+	return NewRedisStorage(redis.NewClient(&redis.Options{Addr: redisServer.Addr()}))
+}
+
+func TestRedisStorage(t *testing.T) {
+	storage := newTestRedisStorage(t)
+	now := time.Now().UnixMilli()
+
+	// A resource limited to 10 requests per minute, with a scheduled call
+	resource := model.Resource{
+		Name:            "test_resource",
+		Algorithm:       model.AlgorithmSlidingWindow,
+		RequestCount:    10,
+		TimeFrame:       60,
+		ScheduledCalls:  []int64{now + 1000},
+		ScheduledTokens: []int{5},
+		Reservations:    map[string]model.Reservation{"id": {Timestamp: now + 1000, Weight: 5}},
+	}
+	if err := storage.Record(resource); err != nil {
+		t.Errorf("failed to record resource: %v", err)
+	}
+	if err := storage.Record(model.Resource{Name: "other_resource", RequestCount: 1, TimeFrame: 1}); err != nil {
+		t.Errorf("failed to record resource: %v", err)
+	}
+
+	loaded, version, exists, err := storage.LoadResource("test_resource")
+	if err != nil || !exists {
+		t.Fatalf("expected the resource to be loaded, got %v", err)
+	}
+	if !reflect.DeepEqual(loaded.ScheduledCalls, resource.ScheduledCalls) || !reflect.DeepEqual(loaded.Reservations, resource.Reservations) {
+		t.Errorf("expected scheduled calls %v, got %v", resource.ScheduledCalls, loaded.ScheduledCalls)
+	}
+
+	// Test cases, each save is made against the version loaded above
+	changed := loaded
+	changed.RequestCount = 20
+	testCases := []struct {
+		name          string
+		changed       model.Resource
+		version       int64
+		expectedSaved bool
+	}{
+		{
+			name:          "Save at the latest version",
+			changed:       changed,
+			version:       version,
+			expectedSaved: true,
+		},
+		{
+			name:          "Save at an outdated version",
+			changed:       changed,
+			version:       version,
+			expectedSaved: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			saved, err := storage.SaveResources([]model.Resource{loaded}, []model.Resource{tc.changed}, []int64{tc.version})
+			if err != nil {
+				t.Errorf("failed to save resource: %v", err)
+			}
+			if saved != tc.expectedSaved {
+				t.Errorf("expected saved to be %v, got %v", tc.expectedSaved, saved)
+			}
+		})
+	}
+
+	// A resource can't be registered twice
+	if added, err := storage.RecordNew(model.Resource{Name: "other_resource", RequestCount: 2, TimeFrame: 1}); err != nil || added {
+		t.Errorf("expected the existing resource not to be registered again, got %v", err)
+	}
+
+	// The deleted resource is no longer loaded
+	if err := storage.RecordDelete("other_resource"); err != nil {
+		t.Errorf("failed to delete resource: %v", err)
+	}
+	resources, err := storage.Load()
+	if err != nil {
+		t.Errorf("failed to load resources: %v", err)
+	}
+	if len(resources) != 1 || resources["test_resource"].RequestCount != 20 {
+		t.Errorf("expected only test_resource to be loaded, got %v", resources)
+	}
+}
+
+func TestRedisStorageScheduledCalls(t *testing.T) {
+	storage := newTestRedisStorage(t)
+	now := time.Now().UnixMilli()
+
+	// A resource limited to 3 requests per minute, with a call scheduled and reserved
+	if err := storage.Record(model.Resource{
+		Name:            "test_resource",
+		RequestCount:    3,
+		TimeFrame:       60,
+		ScheduledCalls:  []int64{now},
+		ScheduledTokens: []int{1},
+		Reservations:    map[string]model.Reservation{"first": {Timestamp: now, Weight: 1}},
+	}); err != nil {
+		t.Fatalf("failed to record resource: %v", err)
+	}
+	loaded, version, _, err := storage.LoadResource("test_resource")
+	if err != nil {
+		t.Fatalf("failed to load resource: %v", err)
+	}
+
+	// Test cases, each one changing the resource loaded above as if scheduled by another server
+	testCases := []struct {
+		name          string
+		calls         []int64
+		tokens        []int
+		reservations  map[string]model.Reservation
+		expectedSaved bool
+		expectedCalls int
+	}{
+		{
+			name:          "Call added",
+			calls:         []int64{now, now + 1000},
+			tokens:        []int{1, 1},
+			reservations:  map[string]model.Reservation{"first": {Timestamp: now, Weight: 1}, "second": {Timestamp: now + 1000, Weight: 1}},
+			expectedSaved: true,
+			expectedCalls: 2,
+		},
+		{
+			name:          "Call added meanwhile, still fitting the limit",
+			calls:         []int64{now, now + 2000},
+			tokens:        []int{1, 1},
+			reservations:  map[string]model.Reservation{"first": {Timestamp: now, Weight: 1}, "third": {Timestamp: now + 2000, Weight: 1}},
+			expectedSaved: true,
+			expectedCalls: 3,
+		},
+		{
+			name:          "Call added meanwhile, beyond the limit",
+			calls:         []int64{now, now + 3000},
+			tokens:        []int{1, 1},
+			reservations:  map[string]model.Reservation{"first": {Timestamp: now, Weight: 1}},
+			expectedSaved: false,
+			expectedCalls: 3,
+		},
+		{
+			name:          "Call released",
+			calls:         []int64{},
+			tokens:        []int{},
+			reservations:  map[string]model.Reservation{},
+			expectedSaved: true,
+			expectedCalls: 2,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			changed := loaded
+			changed.ScheduledCalls, changed.ScheduledTokens, changed.Reservations = tc.calls, tc.tokens, tc.reservations
+			saved, err := storage.SaveResources([]model.Resource{loaded}, []model.Resource{changed}, []int64{version})
+			if err != nil {
+				t.Errorf("failed to save resource: %v", err)
+			}
+			if saved != tc.expectedSaved {
+				t.Errorf("expected saved to be %v, got %v", tc.expectedSaved, saved)
+			}
+
+			// The calls scheduled by every server are kept
+			latest, _, _, err := storage.LoadResource("test_resource")
+			if err != nil {
+				t.Errorf("failed to load resource: %v", err)
+			}
+			if len(latest.ScheduledCalls) != tc.expectedCalls || len(latest.Reservations) != tc.expectedCalls {
+				t.Errorf("expected %d calls and reservations, got %v and %v", tc.expectedCalls, latest.ScheduledCalls, latest.Reservations)
+			}
+		})
+	}
+}
@@ -2,11 +2,34 @@ package storage
 
 import "meter_flow/model"
 
-// "Data Transfer Object" for resources, we don't want to store the "ScheduledCalls"
+// "Data Transfer Object" for resources, the runtime state ("ScheduledCalls", bucket tokens...) is only stored when asked for
 type ResourceDTO struct {
-	Name         string
-	RequestCount int
-	TimeFrame    int
+	Name           string
+	Algorithm      string
+	RequestCount   int
+	TimeFrame      int
+	TimeFrameMs    int
+	TokenCount     int
+	Limits         []model.Limit
+	Parent         string
+	BucketCapacity int
+	RefillRate     float64
+
+	HighPriorityShare float64
+	TenantCap         float64
+	TenantWeights     map[string]float64
+
+	Adaptive             bool
+	AdaptiveRequestCount int
+	UpstreamURL          string
+
+	// Runtime state
+	ScheduledCalls  []int64                      `json:",omitempty"`
+	ScheduledTokens []int                        `json:",omitempty"`
+	Reservations    map[string]model.Reservation `json:",omitempty"`
+	BucketTokens    float64                      `json:",omitempty"`
+	BucketUpdated   int64                        `json:",omitempty"`
+	PausedUntil     int64                        `json:",omitempty"`
 }
 
 // Store and load the server data (resources)
@@ -14,3 +37,127 @@ type Storage interface {
 	Save(resources map[string]model.Resource) error
 	Load() (map[string]model.Resource, error)
 }
+
+// Recorder is implemented by the storages that record each change as it happens, instead of saving every resource
+type Recorder interface {
+	Record(resource model.Resource) error
+	RecordDelete(name string) error
+}
+
+// SharedState is implemented by the storages shared by several servers. The resources are then read from the
+// storage rather than kept in memory, and each change is saved only if no other server changed the resource meanwhile.
+type SharedState interface {
+	Recorder
+
+	// LoadResource returns the latest version of a resource, version numbers start at 1
+	LoadResource(name string) (resource model.Resource, version int64, exists bool, err error)
+	// SaveResources saves together the changes made to resources loaded at the given versions. The settings of
+	// a resource are only saved if it is still at its version, while its calls are saved as the calls added
+	// and removed: they only conflict with the calls other servers scheduled meanwhile if they no longer fit
+	// the limits. It returns false on a conflict.
+	SaveResources(loaded, changed []model.Resource, versions []int64) (bool, error)
+	// RecordNew saves a new resource, it returns false if the resource already exists
+	RecordNew(resource model.Resource) (bool, error)
+}
+
+// toDTO converts a resource to its stored form
+func toDTO(resource model.Resource) ResourceDTO {
+	return ResourceDTO{
+		Name:           resource.Name,
+		Algorithm:      resource.Algorithm,
+		RequestCount:   resource.RequestCount,
+		TimeFrame:      resource.TimeFrame,
+		TimeFrameMs:    resource.TimeFrameMs,
+		TokenCount:     resource.TokenCount,
+		Limits:         resource.Limits,
+		Parent:         resource.Parent,
+		BucketCapacity: resource.BucketCapacity,
+		RefillRate:     resource.RefillRate,
+
+		HighPriorityShare: resource.HighPriorityShare,
+		TenantCap:         resource.TenantCap,
+		TenantWeights:     resource.TenantWeights,
+
+		Adaptive:             resource.Adaptive,
+		AdaptiveRequestCount: resource.AdaptiveRequestCount,
+		UpstreamURL:          resource.UpstreamURL,
+
+		ScheduledCalls:  resource.ScheduledCalls,
+		ScheduledTokens: resource.ScheduledTokens,
+		Reservations:    resource.Reservations,
+		BucketTokens:    resource.BucketTokens,
+		BucketUpdated:   resource.BucketUpdated,
+		PausedUntil:     resource.PausedUntil,
+	}
+}
+
+// withoutState returns the stored resource without its runtime state
+func (dto ResourceDTO) withoutState() ResourceDTO {
+	dto.ScheduledCalls = nil
+	dto.ScheduledTokens = nil
+	dto.Reservations = nil
+	dto.BucketTokens = 0
+	dto.BucketUpdated = 0
+	dto.PausedUntil = 0
+	return dto
+}
+
+// withoutCalls returns the stored resource without its scheduled calls and reservations, which are stored apart
+func (dto ResourceDTO) withoutCalls() ResourceDTO {
+	dto.ScheduledCalls = nil
+	dto.ScheduledTokens = nil
+	dto.Reservations = nil
+	return dto
+}
+
+// fromDTO converts a stored resource back to a full resource. The stored runtime state is pruned of the calls
+// that already left their window, without any stored state the resource starts with no calls and a full bucket.
+func fromDTO(dto ResourceDTO, now int64) model.Resource {
+	resource := model.Resource{
+		Name:                 dto.Name,
+		Algorithm:            dto.Algorithm,
+		RequestCount:         dto.RequestCount,
+		TimeFrame:            dto.TimeFrame,
+		TimeFrameMs:          dto.TimeFrameMs,
+		TokenCount:           dto.TokenCount,
+		Limits:               dto.Limits,
+		Parent:               dto.Parent,
+		HighPriorityShare:    dto.HighPriorityShare,
+		TenantCap:            dto.TenantCap,
+		TenantWeights:        dto.TenantWeights,
+		Adaptive:             dto.Adaptive,
+		AdaptiveRequestCount: dto.AdaptiveRequestCount,
+		UpstreamURL:          dto.UpstreamURL,
+		ScheduledCalls:       []int64{}, // Empty slice for scheduled calls
+		ScheduledTokens:      []int{},
+		Reservations:         make(map[string]model.Reservation),
+		BucketCapacity:       dto.BucketCapacity,
+		RefillRate:           dto.RefillRate,
+		BucketTokens:         float64(dto.BucketCapacity), // Full bucket
+		BucketUpdated:        now,
+		PausedUntil:          dto.PausedUntil,
+	}
+
+	if dto.BucketUpdated != 0 {
+		resource.BucketTokens = dto.BucketTokens
+		resource.BucketUpdated = dto.BucketUpdated
+	}
+
+	start := now - resource.LongestTimeFrameMillis()
+	for i, t := range dto.ScheduledCalls {
+		if t > start {
+			resource.ScheduledCalls = append(resource.ScheduledCalls, t)
+			if i < len(dto.ScheduledTokens) {
+				resource.ScheduledTokens = append(resource.ScheduledTokens, dto.ScheduledTokens[i])
+			} else {
+				resource.ScheduledTokens = append(resource.ScheduledTokens, 0)
+			}
+		}
+	}
+	for id, reservation := range dto.Reservations {
+		if reservation.Timestamp > start {
+			resource.Reservations[id] = reservation
+		}
+	}
+	return resource
+}
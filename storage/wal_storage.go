@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"maps"
+	"meter_flow/model"
+	"os"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Operations recorded in the write-ahead log
+const (
+	walSet    = "set"    // The whole resource
+	walCalls  = "calls"  // The changes of the runtime state of a resource
+	walDelete = "delete" // The deletion of a resource
+)
+
+// walRecord is a line of the write-ahead log
+type walRecord struct {
+	Op       string
+	Name     string       `json:",omitempty"`
+	Resource *ResourceDTO `json:",omitempty"`
+
+	// Changes of the runtime state, the scheduled calls are (timestamp, weight) pairs
+	AddedCalls          [][2]int64                   `json:",omitempty"`
+	RemovedCalls        [][2]int64                   `json:",omitempty"`
+	AddedReservations   map[string]model.Reservation `json:",omitempty"` // New reservations and moved ones
+	RemovedReservations []string                     `json:",omitempty"`
+	BucketTokens        float64                      `json:",omitempty"`
+	BucketUpdated       int64                        `json:",omitempty"`
+	PausedUntil         int64                        `json:",omitempty"`
+}
+
+// WALStorage appends every change of a resource (including its scheduled calls) to a write-ahead log,
+// instead of rewriting every resource. The log is compacted into a snapshot file once it gets long.
+type WALStorage struct {
+	snapshot *FileStorage
+	logPath  string
+
+	// Number of records after which the log is compacted into the snapshot
+	CompactEvery int
+
+	mu      sync.Mutex
+	log     *os.File
+	records int
+	state   map[string]model.Resource // Current resources, written to the snapshot on compaction
+}
+
+func NewWALStorage(snapshotPath, logPath string) *WALStorage {
+	snapshot := NewFileStorage(snapshotPath)
+	snapshot.PersistScheduledCalls = true
+
+	return &WALStorage{
+		snapshot:     snapshot,
+		logPath:      logPath,
+		CompactEvery: 10000,
+		state:        make(map[string]model.Resource),
+	}
+}
+
+// Save writes every resource to the snapshot and starts a new log
+func (ws *WALStorage) Save(resources map[string]model.Resource) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	ws.state = maps.Clone(resources)
+	return ws.compact()
+}
+
+// Load reads the snapshot and replays the log on top of it, then compacts them
+func (ws *WALStorage) Load() (map[string]model.Resource, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	resources, err := ws.snapshot.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(ws.logPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		defer file.Close()
+
+		now := time.Now().UnixMilli()
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, 64*1024*1024)
+		for scanner.Scan() {
+			var record walRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				// A crash in the middle of a write leaves a truncated last record
+				break
+			}
+
+			switch record.Op {
+			case walSet:
+				if record.Resource != nil {
+					resources[record.Resource.Name] = fromDTO(*record.Resource, now)
+				}
+			case walCalls:
+				if resource, exists := resources[record.Name]; exists {
+					resources[record.Name] = fromDTO(applyCalls(toDTO(resource), record), now)
+				}
+			case walDelete:
+				delete(resources, record.Name)
+			}
+		}
+	}
+
+	ws.state = maps.Clone(resources)
+	if err := ws.compact(); err != nil {
+		return nil, err
+	}
+	return resources, nil
+}
+
+// Record appends the new state of a resource to the log. When only its runtime state changed,
+// only the added and removed calls, the added, moved and removed reservations and the pause are appended.
+func (ws *WALStorage) Record(resource model.Resource) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	dto := toDTO(resource)
+	record := walRecord{Op: walSet, Resource: &dto}
+	if previous, exists := ws.state[resource.Name]; exists {
+		previousDTO := toDTO(previous)
+		if reflect.DeepEqual(previousDTO.withoutState(), dto.withoutState()) {
+			record = diffCalls(previousDTO, dto)
+		}
+	}
+
+	return ws.append(record, func() {
+		ws.state[resource.Name] = resource
+	})
+}
+
+// RecordDelete appends the deletion of a resource to the log
+func (ws *WALStorage) RecordDelete(name string) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	return ws.append(walRecord{Op: walDelete, Name: name}, func() {
+		delete(ws.state, name)
+	})
+}
+
+// append writes a record to the log and applies it to the state, compacting the log when it gets long.
+// The caller must hold the mutex.
+func (ws *WALStorage) append(record walRecord, apply func()) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if ws.log == nil {
+		ws.log, err = os.OpenFile(ws.logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := ws.log.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	apply()
+
+	ws.records++
+	if ws.records >= ws.CompactEvery {
+		return ws.compact()
+	}
+	return nil
+}
+
+// compact writes the state to the snapshot and empties the log, the caller must hold the mutex
+func (ws *WALStorage) compact() error {
+	if err := ws.snapshot.Save(ws.state); err != nil {
+		return err
+	}
+
+	// The snapshot now holds every record, start a new log
+	if ws.log != nil {
+		ws.log.Close()
+		ws.log = nil
+	}
+	if err := os.Remove(ws.logPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ws.records = 0
+	return nil
+}
+
+// diffCalls returns the record of the changes of the runtime state between two versions of a resource
+func diffCalls(previous, current ResourceDTO) walRecord {
+	record := walRecord{
+		Op:                walCalls,
+		Name:              current.Name,
+		AddedReservations: make(map[string]model.Reservation),
+		BucketTokens:      current.BucketTokens,
+		BucketUpdated:     current.BucketUpdated,
+		PausedUntil:       current.PausedUntil,
+	}
+
+	// Count the previous calls, the ones left over were removed
+	counts := make(map[[2]int64]int)
+	for i, t := range previous.ScheduledCalls {
+		counts[callPair(t, previous.ScheduledTokens, i)]++
+	}
+	for i, t := range current.ScheduledCalls {
+		call := callPair(t, current.ScheduledTokens, i)
+		if counts[call] > 0 {
+			counts[call]--
+		} else {
+			record.AddedCalls = append(record.AddedCalls, call)
+		}
+	}
+	for call, count := range counts {
+		for ; count > 0; count-- {
+			record.RemovedCalls = append(record.RemovedCalls, call)
+		}
+	}
+
+	for id, reservation := range current.Reservations {
+		if old, exists := previous.Reservations[id]; !exists || old != reservation {
+			record.AddedReservations[id] = reservation
+		}
+	}
+	for id := range previous.Reservations {
+		if _, exists := current.Reservations[id]; !exists {
+			record.RemovedReservations = append(record.RemovedReservations, id)
+		}
+	}
+	return record
+}
+
+// applyCalls applies the changes of the runtime state of a record to a resource
+func applyCalls(dto ResourceDTO, record walRecord) ResourceDTO {
+	removed := make(map[[2]int64]int)
+	for _, call := range record.RemovedCalls {
+		removed[call]++
+	}
+
+	var calls [][2]int64
+	for i, t := range dto.ScheduledCalls {
+		call := callPair(t, dto.ScheduledTokens, i)
+		if removed[call] > 0 {
+			removed[call]--
+			continue
+		}
+		calls = append(calls, call)
+	}
+	calls = append(calls, record.AddedCalls...)
+	slices.SortStableFunc(calls, func(a, b [2]int64) int { return cmp.Compare(a[0], b[0]) })
+
+	dto.ScheduledCalls = make([]int64, len(calls))
+	dto.ScheduledTokens = make([]int, len(calls))
+	for i, call := range calls {
+		dto.ScheduledCalls[i] = call[0]
+		dto.ScheduledTokens[i] = int(call[1])
+	}
+
+	dto.Reservations = maps.Clone(dto.Reservations)
+	if dto.Reservations == nil {
+		dto.Reservations = make(map[string]model.Reservation)
+	}
+	maps.Copy(dto.Reservations, record.AddedReservations)
+	for _, id := range record.RemovedReservations {
+		delete(dto.Reservations, id)
+	}
+
+	dto.BucketTokens = record.BucketTokens
+	dto.BucketUpdated = record.BucketUpdated
+	dto.PausedUntil = record.PausedUntil
+	return dto
+}
+
+// callPair returns the timestamp and weight of a scheduled call, missing weights count as 0
+func callPair(t int64, tokens []int, i int) [2]int64 {
+	if i < len(tokens) {
+		return [2]int64{t, int64(tokens[i])}
+	}
+	return [2]int64{t, 0}
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"meter_flow/model"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWALStorage(t *testing.T) {
+	dir := t.TempDir()
+	snapshotPath := filepath.Join(dir, "resources.json")
+	logPath := filepath.Join(dir, "resources.wal")
+	now := time.Now().UnixMilli()
+
+	storage := NewWALStorage(snapshotPath, logPath)
+	if _, err := storage.Load(); err != nil {
+		t.Errorf("failed to load resources: %v", err)
+	}
+
+	// Register two resources, schedule calls on one of them and delete the other
+	resource := model.Resource{Name: "test_resource", RequestCount: 10, TimeFrame: 60}
+	records := []func() error{
+		func() error { return storage.Record(resource) },
+		func() error {
+			return storage.Record(model.Resource{Name: "other_resource", RequestCount: 1, TimeFrame: 1})
+		},
+		func() error {
+			resource.ScheduledCalls = []int64{now, now + 1000}
+			resource.ScheduledTokens = []int{10, 20}
+			resource.Reservations = map[string]model.Reservation{"first": {Timestamp: now, Weight: 10}, "second": {Timestamp: now + 1000, Weight: 20}}
+			return storage.Record(resource)
+		},
+		func() error {
+			// The first call is released
+			resource.ScheduledCalls = []int64{now + 1000}
+			resource.ScheduledTokens = []int{20}
+			resource.Reservations = map[string]model.Reservation{"second": {Timestamp: now + 1000, Weight: 20}}
+			return storage.Record(resource)
+		},
+		func() error { return storage.RecordDelete("other_resource") },
+	}
+	for _, record := range records {
+		if err := record(); err != nil {
+			t.Errorf("failed to record change: %v", err)
+		}
+	}
+
+	// Only the log was written, the snapshot is the empty one written on load
+	if info, err := os.Stat(logPath); err != nil || info.Size() == 0 {
+		t.Errorf("expected the changes to be in the log")
+	}
+
+	// A crash in the middle of a write leaves a truncated record behind
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Errorf("failed to open log: %v", err)
+	}
+	file.WriteString(`{"Op":"delete","Na`)
+	file.Close()
+
+	// Replay the log in a new storage
+	loaded, err := NewWALStorage(snapshotPath, logPath).Load()
+	if err != nil {
+		t.Errorf("failed to load resources: %v", err)
+	}
+
+	if len(loaded) != 1 {
+		t.Errorf("expected 1 resource, got %d", len(loaded))
+	}
+	replayed := loaded["test_resource"]
+	if !reflect.DeepEqual(replayed.ScheduledCalls, []int64{now + 1000}) || !reflect.DeepEqual(replayed.ScheduledTokens, []int{20}) {
+		t.Errorf("expected the second call to be scheduled, got %v with tokens %v", replayed.ScheduledCalls, replayed.ScheduledTokens)
+	}
+	if _, exists := replayed.Reservations["second"]; !exists || len(replayed.Reservations) != 1 {
+		t.Errorf("expected the second reservation only, got %v", replayed.Reservations)
+	}
+
+	// Loading compacts the log into the snapshot
+	if _, err := os.Stat(logPath); !os.IsNotExist(err) {
+		t.Errorf("expected the log to be compacted")
+	}
+}
+
+func TestWALStorageCompaction(t *testing.T) {
+	dir := t.TempDir()
+	snapshotPath := filepath.Join(dir, "resources.json")
+	logPath := filepath.Join(dir, "resources.wal")
+
+	storage := NewWALStorage(snapshotPath, logPath)
+	storage.CompactEvery = 3
+
+	for i := 1; i <= 3; i++ {
+		if err := storage.Record(model.Resource{Name: "test_resource", RequestCount: i, TimeFrame: 60}); err != nil {
+			t.Errorf("failed to record change: %v", err)
+		}
+	}
+
+	// The third record triggered a compaction
+	if _, err := os.Stat(logPath); !os.IsNotExist(err) {
+		t.Errorf("expected the log to be compacted")
+	}
+	loaded, err := NewFileStorage(snapshotPath).Load()
+	if err != nil {
+		t.Errorf("failed to load snapshot: %v", err)
+	}
+	if loaded["test_resource"].RequestCount != 3 {
+		t.Errorf("expected the snapshot to have the last change, got %d requests", loaded["test_resource"].RequestCount)
+	}
+}